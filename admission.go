@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+// AdmissionConfig configures the admission control of a ClientState for
+// cold decryptions, i.e., decryptions of ciphertexts that are not in its cache
+// (see WithAdmissionControl).
+type AdmissionConfig struct {
+	// Rate is the number of cold decryptions per second allowed for each
+	// hierarchy, or for each key returned by Key.
+	Rate float64
+
+	// Burst is the number of cold decryptions allowed in quick succession
+	// for each hierarchy, or for each key returned by Key, before Rate
+	// applies. If it is less than 1, it is treated as 1.
+	Burst int
+
+	// Key returns the key under which a cold decryption with the provided
+	// hierarchy and pattern is rate-limited. If it is nil, cold decryptions
+	// are rate-limited per hierarchy. To rate-limit them per URI, Key can
+	// return the hierarchy and the URI decoded from the pattern (e.g., with
+	// DecodePattern, for patterns produced by the default PatternEncoder).
+	Key func(hierarchy []byte, pattern Pattern) string
+}
+
+// ErrDecryptionRateLimited is returned when decrypting a ciphertext that is
+// not in the cache would exceed the rate configured with
+// WithAdmissionControl.
+var ErrDecryptionRateLimited = errors.New("too many decryptions of uncached ciphertexts")
+
+// admissionSweepThreshold is the number of rate-limiting keys that an
+// admissionControl tracks before it first discards those that are idle.
+const admissionSweepThreshold = 1024
+
+// admissionControl rate-limits cold decryptions with a token bucket for each
+// rate-limiting key.
+type admissionControl struct {
+	config  AdmissionConfig
+	lock    sync.Mutex
+	buckets map[string]*admissionBucket
+	sweepAt int
+}
+
+// admissionBucket is the token bucket for one rate-limiting key. It holds
+// the number of cold decryptions allowed as of the time it was last updated.
+type admissionBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newAdmissionControl(config AdmissionConfig) *admissionControl {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	return &admissionControl{
+		config:  config,
+		buckets: make(map[string]*admissionBucket),
+		sweepAt: admissionSweepThreshold,
+	}
+}
+
+// refill adds the tokens accumulated by the bucket since it was last updated,
+// up to the burst size.
+func (admission *admissionControl) refill(bucket *admissionBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * admission.config.Rate
+	if burst := float64(admission.config.Burst); bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.updated = now
+}
+
+// admit reports whether a cold decryption with the provided hierarchy and
+// pattern is allowed at the provided time, and if so, accounts for it.
+func (admission *admissionControl) admit(hierarchy []byte, pattern Pattern, now time.Time) bool {
+	var key string
+	if admission.config.Key != nil {
+		key = admission.config.Key(hierarchy, pattern)
+	} else {
+		key = string(hierarchy)
+	}
+
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	bucket, ok := admission.buckets[key]
+	if ok {
+		admission.refill(bucket, now)
+	} else {
+		if len(admission.buckets) >= admission.sweepAt {
+			admission.sweep(now)
+		}
+		bucket = &admissionBucket{tokens: float64(admission.config.Burst), updated: now}
+		admission.buckets[key] = bucket
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep discards the buckets that have refilled completely, since a new
+// bucket would behave in the same way, so that keys that are used only
+// briefly do not accumulate. The next sweep happens once the number of
+// buckets has doubled.
+func (admission *admissionControl) sweep(now time.Time) {
+	burst := float64(admission.config.Burst)
+	for key, bucket := range admission.buckets {
+		admission.refill(bucket, now)
+		if bucket.tokens >= burst {
+			delete(admission.buckets, key)
+		}
+	}
+	admission.sweepAt = 2 * len(admission.buckets)
+	if admission.sweepAt < admissionSweepThreshold {
+		admission.sweepAt = admissionSweepThreshold
+	}
+}
+
+// coldDecryptionKey is the context key under which the ClientState passes
+// the ciphertext being decrypted to cacheGet, so that, if the ciphertext's
+// decryption cache entry is not in the cache, the loader can check the
+// ciphertext and admit its decryption before creating the entry.
+type coldDecryptionKey struct{}
+
+// coldDecryption describes a decryption whose cache entry may need to be
+// loaded. If the entry is loaded, the ciphertext parsed from encryptedKey to
+// check it is kept, so that the decryption does not parse it again.
+type coldDecryption struct {
+	hierarchy    []byte
+	pattern      Pattern
+	encryptedKey []byte
+	ciphertext   *wkdibe.Ciphertext
+}
+
+// withColdDecryption returns a context that passes the provided decryption
+// to the loader of its cache entry.
+func withColdDecryption(ctx context.Context, cold *coldDecryption) context.Context {
+	return context.WithValue(ctx, coldDecryptionKey{}, cold)
+}
+
+// admitColdDecryption is called before a decryption cache entry is created.
+// It parses the ciphertext in the decryption passed in the context, checking
+// that it is well-formed, which is much cheaper than the key store lookup and
+// pairing that its decryption would otherwise cost, and then applies the rate
+// limit configured with WithAdmissionControl, if any. The parsed ciphertext
+// is kept in the decryption for the caller to decrypt.
+func (state *ClientState) admitColdDecryption(ctx context.Context) error {
+	cold, ok := ctx.Value(coldDecryptionKey{}).(*coldDecryption)
+	if !ok {
+		return nil
+	}
+
+	ciphertext, err := state.unmarshalCiphertext(cold.encryptedKey)
+	if err != nil {
+		return err
+	}
+
+	if state.admission != nil && !state.admission.admit(cold.hierarchy, cold.pattern, time.Now()) {
+		return ErrDecryptionRateLimited
+	}
+	cold.ciphertext = ciphertext
+	return nil
+}
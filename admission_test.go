@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+type missingKeyStore struct {
+	KeyStoreReader
+}
+
+func (mks *missingKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	return nil, nil, nil
+}
+
+func decryptionEntries(state *ClientState) int {
+	count := 0
+	for key := range liveEntries(state) {
+		if cacheKindOf(key) == CacheKindDecryption {
+			count++
+		}
+	}
+	return count
+}
+
+func NewAdmissionTestState(config AdmissionConfig) *ClientState {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	return NewClientState(info, store, encoder, 1<<20, WithAdmissionControl(config))
+}
+
+func TestAdmissionRateLimit(t *testing.T) {
+	state := NewAdmissionTestState(AdmissionConfig{Rate: 1e-6, Burst: 2})
+	ctx := context.Background()
+	now := time.Now()
+
+	uris := []string{"a/b/0", "a/b/1", "a/b/2"}
+	encrypted := make([][]byte, len(uris))
+	for i, uri := range uris {
+		var err error
+		if encrypted[i], err = state.Encrypt(ctx, TestHierarchy, uri, now, []byte(quote1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i != 2; i++ {
+		if _, err := state.Decrypt(ctx, TestHierarchy, uris[i], now, encrypted[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := state.Decrypt(ctx, TestHierarchy, uris[2], now, encrypted[2]); err != ErrDecryptionRateLimited {
+		t.Fatalf("Cold decryption beyond the burst returned %v", err)
+	}
+	if count := decryptionEntries(state); count != 2 {
+		t.Fatalf("Expected 2 decryption entries, got %d", count)
+	}
+
+	/* Cached decryptions are not limited. */
+	decrypted, err := state.Decrypt(ctx, TestHierarchy, uris[0], now, encrypted[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != quote1 {
+		t.Fatal("Original and decrypted messages differ")
+	}
+
+	/* Other hierarchies have their own limit. */
+	testMessageTransfer(t, state, []byte("otherHierarchy"), "a/b/c", now, quote2)
+}
+
+func TestAdmissionPerURI(t *testing.T) {
+	state := NewAdmissionTestState(AdmissionConfig{
+		Rate:  1e-6,
+		Burst: 1,
+		Key: func(hierarchy []byte, pattern Pattern) string {
+			uriPath, _ := DecodePattern(pattern)
+			return string(hierarchy) + "/" + uriPath.String()
+		},
+	})
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+	if err := transferMessage(state, TestHierarchy, "a/b/c", now.Add(2*time.Hour), quote1); err != ErrDecryptionRateLimited {
+		t.Fatalf("Second cold decryption for the URI returned %v", err)
+	}
+	testMessageTransfer(t, state, TestHierarchy, "a/b/d", now, quote2)
+}
+
+func TestAdmissionMalformedCiphertext(t *testing.T) {
+	info, store := NewTestKeyStore()
+	counting := &countingKeyStore{KeyStoreReader: store}
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(info, counting, encoder, 1<<20, WithAdmissionControl(AdmissionConfig{Rate: 1e-6, Burst: 1}))
+	ctx := context.Background()
+	now := time.Now()
+
+	encrypted, err := state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 3; i++ {
+		invalid := append([]byte(nil), encrypted...)
+		invalid[ParamEpochLength+i] ^= 0x01
+		if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, invalid); err == nil {
+			t.Fatal("No error for decrypting a malformed header")
+		}
+	}
+	if count := decryptionEntries(state); count != 0 {
+		t.Fatalf("Malformed headers created %d decryption entries", count)
+	}
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 0 {
+		t.Fatalf("Malformed headers cost %d key store lookups", lookups)
+	}
+
+	/* Malformed headers are rejected before they count against the rate. */
+	decrypted, err := state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != quote1 {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
+
+func TestFailedDecryptionNotCached(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	encrypting := NewClientState(info, store, encoder, 1<<20)
+	state := NewClientState(info, &missingKeyStore{store}, encoder, 1<<20)
+	ctx := context.Background()
+	now := time.Now()
+
+	encrypted, err := encrypting.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != ErrKeyNotFound {
+		t.Fatalf("Decrypting without a key returned %v", err)
+	}
+	if count := decryptionEntries(state); count != 0 {
+		t.Fatalf("Failed decryption left %d decryption entries", count)
+	}
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// DefaultBlobChunkSize is the default size (in bytes) of the plaintext in each
+// chunk of an encrypted blob.
+const DefaultBlobChunkSize = 64 << 10
+
+// MaxBlobChunkSize is the maximum size (in bytes) of the plaintext in each
+// chunk of an encrypted blob. The chunk size is read from the blob's header
+// before the blob is authenticated, so it is bounded to limit the memory
+// that a malformed blob can cause OpenBlob and ReadAt to allocate.
+const MaxBlobChunkSize = 16 << 20
+
+// blobSaltSize is the size (in bytes) of the random salt in a blob's header,
+// used to derive a key specific to that blob.
+const blobSaltSize = 16
+
+// cipherSuiteAES128GCMBlob identifies the key used to encrypt the chunks of a
+// blob. It is used both to derive the blob's key from the WKD-IBE plaintext
+// and to derive the per-blob subkey from that key and the blob's salt.
+const cipherSuiteAES128GCMBlob = "AES-128-GCM-CHUNKED"
+
+// BlobHeaderSize is the size (in bytes) of the header at the beginning of an
+// encrypted blob. The header consists of the marshalled type, the WKD-IBE
+// ciphertext of the symmetric key, a random salt, the chunk size, and the
+// size of the plaintext.
+var BlobHeaderSize = 1 + EncryptedKeySize + blobSaltSize + 4 + 8
+
+// EncryptBlob encrypts size bytes read from src into a seekable blob, which
+// is written to dst. Unlike Encrypt, which must decrypt the whole message at
+// once, a blob is split into fixed-size chunks of chunkSize bytes (or
+// DefaultBlobChunkSize bytes, if chunkSize is zero), each of which is
+// independently authenticated, so that arbitrary byte ranges can be
+// decrypted with OpenBlob. The entire blob shares a single WKD-IBE ciphertext,
+// which is stored in the blob's header.
+func (state *ClientState) EncryptBlob(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, dst io.Writer, src io.Reader, size int64, chunkSize int) error {
+	if chunkSize == 0 {
+		chunkSize = DefaultBlobChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxBlobChunkSize {
+		return errors.New("invalid blob chunk size")
+	}
+	if size < 0 {
+		return errors.New("invalid blob size")
+	}
+
+	uriPath, pattern, err := state.encodePattern(uri, timestamp)
+	if err != nil {
+		return err
+	}
+
+	/* Construct the header. */
+	header := newMessageBuffer(BlobHeaderSize, MarshalledTypeBlob)[:BlobHeaderSize]
+	encryptedKey := header[1 : 1+EncryptedKeySize]
+	salt := header[1+EncryptedKeySize : 1+EncryptedKeySize+blobSaltSize]
+	binary.LittleEndian.PutUint32(header[BlobHeaderSize-12:BlobHeaderSize-8], uint32(chunkSize))
+	binary.LittleEndian.PutUint64(header[BlobHeaderSize-8:], uint64(size))
+
+	var key [AESKeySize]byte
+	defer zeroBytes(key[:])
+	if key, err = state.encryptionKey(ctx, hierarchy, uriPath, pattern, timestamp, cipherSuiteAES128GCMBlob, encryptedKey); err != nil {
+		return err
+	}
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+
+	var aead cipher.AEAD
+	if aead, err = newSubkeyAEAD(key[:], salt, cipherSuiteAES128GCMBlob); err != nil {
+		return err
+	}
+
+	if _, err = dst.Write(header); err != nil {
+		return err
+	}
+
+	/* Encrypt and write each chunk. */
+	plaintext := make([]byte, chunkSize)
+	ciphertext := make([]byte, 0, chunkSize+aead.Overhead())
+	for index := int64(0); index*int64(chunkSize) < size; index++ {
+		chunk := plaintext
+		if remaining := size - index*int64(chunkSize); remaining < int64(chunkSize) {
+			chunk = plaintext[:remaining]
+		}
+		if _, err = io.ReadFull(src, chunk); err != nil {
+			return err
+		}
+		ciphertext = aead.Seal(ciphertext[:0], blobChunkNonce(index), chunk, header)
+		if _, err = dst.Write(ciphertext); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BlobReader provides random access to the plaintext of an encrypted blob.
+// It is safe to call ReadAt from multiple goroutines concurrently.
+type BlobReader struct {
+	src       io.ReaderAt
+	header    []byte
+	chunkSize int
+	size      int64
+	aead      cipher.AEAD
+}
+
+// OpenBlob reads the header of a blob produced by EncryptBlob and decrypts
+// the symmetric key in it, returning a BlobReader that can decrypt arbitrary
+// byte ranges of the blob. As with Decrypt, the key is looked up using the
+// URI and time with which the blob was encrypted.
+func (state *ClientState) OpenBlob(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, src io.ReaderAt) (*BlobReader, error) {
+	header := make([]byte, BlobHeaderSize)
+	if n, err := src.ReadAt(header, 0); n != len(header) {
+		if err == nil || err == io.EOF {
+			err = errors.New("blob is too short to be valid")
+		}
+		return nil, err
+	}
+	if checkMessageType(header, MarshalledTypeBlob) == nil {
+		return nil, errors.New("not an encrypted blob")
+	}
+
+	chunkSize := binary.LittleEndian.Uint32(header[BlobHeaderSize-12 : BlobHeaderSize-8])
+	size := int64(binary.LittleEndian.Uint64(header[BlobHeaderSize-8:]))
+	if chunkSize == 0 || chunkSize > MaxBlobChunkSize || size < 0 {
+		return nil, errors.New("malformed blob header")
+	}
+
+	br := &BlobReader{
+		src:       src,
+		header:    header,
+		chunkSize: int(chunkSize),
+		size:      size,
+	}
+
+	_, pattern, err := state.encodePattern(uri, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [AESKeySize]byte
+	defer zeroBytes(key[:])
+	if key, err = state.decryptionKey(ctx, hierarchy, pattern, cipherSuiteAES128GCMBlob, header[1:1+EncryptedKeySize]); err != nil {
+		return nil, err
+	}
+	if br.aead, err = newSubkeyAEAD(key[:], header[1+EncryptedKeySize:1+EncryptedKeySize+blobSaltSize], cipherSuiteAES128GCMBlob); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// Size returns the size (in bytes) of the blob's plaintext.
+func (br *BlobReader) Size() int64 {
+	return br.size
+}
+
+// ReadAt decrypts len(p) bytes of the blob's plaintext, starting at offset
+// off, into p. It satisfies the io.ReaderAt interface. An error is returned
+// if any chunk containing the requested bytes fails authentication.
+func (br *BlobReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var ciphertext []byte
+	var plaintext []byte
+
+	n := 0
+	for n != len(p) && off < br.size {
+		if ciphertext == nil {
+			/*
+			 * Don't allocate more than the largest chunk in this blob, which
+			 * is smaller than the chunk size if the blob is small.
+			 */
+			bufferSize := br.chunkSize
+			if br.size < int64(bufferSize) {
+				bufferSize = int(br.size)
+			}
+			ciphertext = make([]byte, bufferSize+br.aead.Overhead())
+			plaintext = make([]byte, 0, bufferSize)
+		}
+
+		index := off / int64(br.chunkSize)
+		chunk, err := br.readChunk(index, ciphertext, plaintext)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], chunk[off-index*int64(br.chunkSize):])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n != len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunk reads the chunk at the specified index from the blob, and
+// decrypts it into the plaintext buffer. The ciphertext buffer must be large
+// enough to hold an encrypted chunk.
+func (br *BlobReader) readChunk(index int64, ciphertext []byte, plaintext []byte) ([]byte, error) {
+	start := index * int64(br.chunkSize)
+	length := int64(br.chunkSize)
+	if remaining := br.size - start; remaining < length {
+		length = remaining
+	}
+
+	encryptedChunkSize := int64(br.chunkSize + br.aead.Overhead())
+	ciphertext = ciphertext[:length+int64(br.aead.Overhead())]
+	if n, err := br.src.ReadAt(ciphertext, int64(BlobHeaderSize)+index*encryptedChunkSize); n != len(ciphertext) {
+		if err == nil || err == io.EOF {
+			err = errors.New("blob is truncated")
+		}
+		return nil, err
+	}
+
+	chunk, err := br.aead.Open(plaintext[:0], blobChunkNonce(index), ciphertext, br.header)
+	if err != nil {
+		return nil, errors.New("blob chunk failed authentication")
+	}
+	return chunk, nil
+}
+
+// blobChunkNonce returns the nonce used to encrypt the chunk at the specified
+// index. Using the index as the nonce ensures that chunks cannot be reordered.
+func blobChunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce, uint64(index))
+	return nonce
+}
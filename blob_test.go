@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBlobReadAt(t *testing.T) {
+	var err error
+	state := NewTestState()
+	now := time.Now()
+	ctx := context.Background()
+
+	const chunkSize = 4096
+	plaintext := make([]byte, 10*chunkSize+123)
+	if _, err = rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	var blob bytes.Buffer
+	if err = state.EncryptBlob(ctx, TestHierarchy, "a/b/c", now, &blob, bytes.NewReader(plaintext), int64(len(plaintext)), chunkSize); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader *BlobReader
+	if reader, err = state.OpenBlob(ctx, TestHierarchy, "a/b/c", now, bytes.NewReader(blob.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if reader.Size() != int64(len(plaintext)) {
+		t.Fatalf("Blob has size %d, expected %d", reader.Size(), len(plaintext))
+	}
+
+	ranges := [][2]int{{0, 10}, {chunkSize - 5, chunkSize + 5}, {100, 3*chunkSize + 7}, {len(plaintext) - 200, len(plaintext)}, {0, len(plaintext)}}
+	for _, r := range ranges {
+		buf := make([]byte, r[1]-r[0])
+		var n int
+		if n, err = reader.ReadAt(buf, int64(r[0])); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(buf) || !bytes.Equal(buf, plaintext[r[0]:r[1]]) {
+			t.Fatalf("Decrypted range [%d, %d) differs from original", r[0], r[1])
+		}
+	}
+
+	/* Reading past the end returns io.EOF. */
+	buf := make([]byte, 100)
+	var n int
+	if n, err = reader.ReadAt(buf, int64(len(plaintext)-50)); err != io.EOF || n != 50 {
+		t.Fatalf("Expected 50 bytes and io.EOF, got %d bytes and %v", n, err)
+	}
+}
+
+func TestBlobTampered(t *testing.T) {
+	var err error
+	state := NewTestState()
+	now := time.Now()
+	ctx := context.Background()
+
+	const chunkSize = 1024
+	plaintext := make([]byte, 4*chunkSize)
+
+	var blob bytes.Buffer
+	if err = state.EncryptBlob(ctx, TestHierarchy, "a/b/c", now, &blob, bytes.NewReader(plaintext), int64(len(plaintext)), chunkSize); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Flip a bit in the third chunk. */
+	encrypted := blob.Bytes()
+	encrypted[BlobHeaderSize+2*(chunkSize+16)+7] ^= 0x1
+
+	var reader *BlobReader
+	if reader, err = state.OpenBlob(ctx, TestHierarchy, "a/b/c", now, bytes.NewReader(encrypted)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, chunkSize)
+	if _, err = reader.ReadAt(buf, chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reader.ReadAt(buf, 2*chunkSize); err == nil {
+		t.Fatal("No error for reading a tampered chunk")
+	}
+
+	/* A truncated blob is detected when reading the last chunk. */
+	if reader, err = state.OpenBlob(ctx, TestHierarchy, "a/b/c", now, bytes.NewReader(encrypted[:len(encrypted)-1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reader.ReadAt(buf, 3*chunkSize); err == nil {
+		t.Fatal("No error for reading a truncated blob")
+	}
+}
+
+func TestBlobChunkSizeBounded(t *testing.T) {
+	var err error
+	state := NewTestState()
+	now := time.Now()
+	ctx := context.Background()
+
+	var blob bytes.Buffer
+	if err = state.EncryptBlob(ctx, TestHierarchy, "a/b/c", now, &blob, bytes.NewReader(nil), 0, MaxBlobChunkSize+1); err == nil {
+		t.Fatal("No error for encrypting a blob with an oversized chunk size")
+	}
+
+	plaintext := make([]byte, 100)
+	if err = state.EncryptBlob(ctx, TestHierarchy, "a/b/c", now, &blob, bytes.NewReader(plaintext), int64(len(plaintext)), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The chunk size in the header is not authenticated until a read. */
+	encrypted := blob.Bytes()
+	binary.LittleEndian.PutUint32(encrypted[BlobHeaderSize-12:BlobHeaderSize-8], 0xFFFFFFFF)
+	if _, err = state.OpenBlob(ctx, TestHierarchy, "a/b/c", now, bytes.NewReader(encrypted)); err == nil {
+		t.Fatal("No error for opening a blob with an oversized chunk size")
+	}
+}
+
+func TestBlobKeyCipherSuite(t *testing.T) {
+	var err error
+	state := NewTestState()
+	now := time.Now()
+	ctx := context.Background()
+
+	plaintext := make([]byte, 100)
+	var blob bytes.Buffer
+	if err = state.EncryptBlob(ctx, TestHierarchy, "a/b/c", now, &blob, bytes.NewReader(plaintext), int64(len(plaintext)), 0); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := blob.Bytes()
+	encryptedKey := encrypted[1 : 1+EncryptedKeySize]
+	salt := encrypted[1+EncryptedKeySize : 1+EncryptedKeySize+blobSaltSize]
+	chunk := encrypted[BlobHeaderSize:]
+
+	_, pattern, err := state.encodePattern("a/b/c", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* The chunks must not be encrypted with the key used for AES-CTR. */
+	for _, suite := range []string{cipherSuiteAES128CTR, cipherSuiteAES128GCMBlob} {
+		var key [AESKeySize]byte
+		if key, err = state.decryptionKey(ctx, TestHierarchy, pattern, suite, encryptedKey); err != nil {
+			t.Fatal(err)
+		}
+		aead, err := newSubkeyAEAD(key[:], salt, cipherSuiteAES128GCMBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = aead.Open(nil, blobChunkNonce(0), chunk, encrypted[:BlobHeaderSize])
+		if (err == nil) != (suite == cipherSuiteAES128GCMBlob) {
+			t.Fatalf("Unexpected result opening a chunk with the %s key: %v", suite, err)
+		}
+	}
+}
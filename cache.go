@@ -33,11 +33,19 @@
 package jedi
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/big"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/samkumar/reqcache"
@@ -48,30 +56,351 @@ import (
 // ClientState is the state that JEDI principals keep in memory to accelerate
 // encryption, decryption, signing, and verification of messages.
 type ClientState struct {
-	info    PublicInfoReader
-	store   KeyStoreReader
-	encoder PatternEncoder
-	cache   *reqcache.LRUCache
+	info          PublicInfoReader
+	store         KeyStoreReader
+	encoder       PatternEncoder
+	patternOnce   sync.Once
+	patternLen    int
+	cache         Cache
+	loader        *cacheLoader
+	nearby        *encryptionIndex
+	subscriptions *subscriptionRegistry
+
+	/* Configuration set by ClientOptions. */
+	trustedCiphertexts  bool
+	legacyKeyDerivation bool
+	unversionedMessages bool
+	observer            Observer
+	encryptionExpiry    bool
+	encryptionGrace     time.Duration
+	decryptionTTL       time.Duration
+	encryptionSlots     int
+	expiry              *expiryQueue
+	lockedKeys          int
+	keys                *keyPool
+	tenants             *TenantConfig
+	admission           *admissionControl
+}
+
+// ErrClientStateClosed is returned by operations on a ClientState after its
+// Close function has been called.
+var ErrClientStateClosed = errors.New("ClientState is closed")
+
+// CacheLoader creates the objects that a ClientState stores in its Cache, and
+// releases them when they are evicted. Each ClientState has its own
+// CacheLoader, which a Cache shared by multiple ClientStates uses to tell
+// their objects apart. CacheLoaders are comparable, and may be used as (part
+// of) a map key.
+type CacheLoader interface {
+	// Load creates the object to be stored under the provided key when it
+	// is not in the cache, and returns it with its size in bytes.
+	Load(ctx context.Context, key string) (interface{}, uint64, error)
+
+	// Evicted is called after the object stored under the provided key is
+	// evicted from the cache.
+	Evicted(key string, value interface{})
+}
+
+// Cache stores the objects that ClientStates use to accelerate JEDI's crypto
+// operations. The default implementation, created by NewLRUCache, is an LRU
+// cache with a bounded capacity. A Cache must be safe for concurrent use.
+type Cache interface {
+	// Get returns the object of the provided kind stored under key for
+	// loader, calling loader.Load to create it if it is not in the cache.
+	// Objects stored by different loaders must be kept separate, even if
+	// their keys are the same. Concurrent calls to Get for the same object
+	// should wait for a single call to loader.Load.
+	Get(ctx context.Context, loader CacheLoader, kind CacheKind, key string) (interface{}, error)
+
+	// Evict removes the object of the provided kind stored under key for
+	// loader, if it is in the cache, and calls loader.Evicted for it.
+	Evict(loader CacheLoader, kind CacheKind, key string)
+}
+
+// hierarchyCacheEntry stores the epochs of public parameters of a JEDI
+// hierarchy, with the newest epoch first.
+type hierarchyCacheEntry struct {
+	epochs []ParamEpoch
+}
+
+// newest returns the epoch of public parameters under which new messages are
+// encrypted.
+func (entry *hierarchyCacheEntry) newest() *ParamEpoch {
+	return &entry.epochs[0]
 }
 
-// hierarchyCacheEntry stores the public parameters of a JEDI hierarchy.
-type hierarchyCacheEntry wkdibe.Params
+// accepted returns the epoch of public parameters with the provided number,
+// and true, if messages produced under it may still be decrypted at the
+// provided time.
+func (entry *hierarchyCacheEntry) accepted(epoch uint32, now time.Time) (*ParamEpoch, bool) {
+	for i := range entry.epochs {
+		current := &entry.epochs[i]
+		if current.Epoch == epoch {
+			return current, current.Retired.IsZero() || now.Before(current.Retired)
+		}
+	}
+	return nil, false
+}
 
 // encryptionCacheEntry stores cached data to accelerate encryption for a URI.
+// It has a slot for each of the patterns (i.e., hours) of the URI used most
+// recently, up to the number configured with WithEncryptionSlots, so that
+// messages for different hours can be interleaved without recomputing the
+// encryption each time. Once the entry is evicted, the key material in its
+// slots is wiped, and it is marked so that goroutines that looked it up
+// before it was evicted don't use it.
 type encryptionCacheEntry struct {
-	lock         sync.RWMutex
+	lock    sync.RWMutex
+	uriPath URIPath
+	slots   []*encryptionSlot
+	clock   uint64
+	wiped   bool
+}
+
+// encryptionSlot stores the symmetric key used to encrypt messages with one
+// pattern of a URI, along with its WKD-IBE ciphertext and the precomputation
+// for the pattern. The used field orders the slots of an entry by when they
+// were last used. A slot restored from a snapshot has no precomputation or
+// attribute list, and only the AES-CTR key in its key material; it is rebuilt
+// from scratch when anything else is needed.
+type encryptionSlot struct {
+	epoch        uint32
+	timestamp    time.Time
 	pattern      Pattern
 	attrs        wkdibe.AttributeList
-	key          [AESKeySize]byte
+	material     *keyMaterial
 	encryptedKey *wkdibe.Ciphertext
 	precomputed  *wkdibe.PreparedAttributeList
+	restored     bool
+	used         uint64
 }
 
-// decryptionCacheEntry stores the cached decryption of a ciphertext.
+// decryptionCacheEntry stores the cached decryption of a ciphertext, along
+// with the ciphertext itself, since the cache key contains only its digest. As
+// with encryptionCacheEntry, it is wiped once it is evicted.
 type decryptionCacheEntry struct {
 	lock      sync.RWMutex
-	decrypted [AESKeySize]byte
+	header    []byte
+	material  *keyMaterial
 	populated bool
+	pending   *decryptionCall
+	wiped     bool
+}
+
+// decryptionCall represents a decryption in progress for a
+// decryptionCacheEntry. Goroutines that need the same decryption wait for the
+// done channel to be closed instead of decrypting the ciphertext themselves,
+// and then read the decryption from the entry. The number of goroutines
+// waiting is maintained atomically in waiters.
+type decryptionCall struct {
+	done      chan struct{}
+	err       error
+	abandoned bool
+	waiters   int32
+}
+
+// qualifiedKeyCacheEntry stores a secret key, qualified to a fully-specified
+// pattern, that can be used to decrypt ciphertexts encrypted with that
+// pattern. The key is held as a reader while it is used, and is wiped and set
+// to nil once the entry is evicted.
+type qualifiedKeyCacheEntry struct {
+	lock sync.RWMutex
+	key  *wkdibe.SecretKey
+}
+
+// wipeCacheEntry overwrites the key material in a cache entry that is no
+// longer in the cache, and marks the entry so that it is not used or
+// repopulated by goroutines that looked it up before it was evicted.
+func (state *ClientState) wipeCacheEntry(value interface{}) {
+	switch entry := value.(type) {
+	case *encryptionCacheEntry:
+		entry.lock.Lock()
+		for _, slot := range entry.slots {
+			state.releaseKeyMaterial(slot.material)
+			slot.material = nil
+			slot.pattern = nil
+			slot.attrs = nil
+			slot.encryptedKey = nil
+			slot.precomputed = nil
+		}
+		entry.slots = nil
+		entry.wiped = true
+		entry.lock.Unlock()
+	case *decryptionCacheEntry:
+		entry.lock.Lock()
+		state.releaseKeyMaterial(entry.material)
+		entry.material = nil
+		entry.header = nil
+		entry.populated = false
+		entry.wiped = true
+		entry.lock.Unlock()
+	case *qualifiedKeyCacheEntry:
+		entry.lock.Lock()
+		if entry.key != nil {
+			wipeSecretKey(entry.key)
+			entry.key = nil
+		}
+		entry.lock.Unlock()
+	}
+}
+
+// touch marks a slot of this entry as the most recently used. The caller
+// must hold the entry's lock, but may hold it as a reader.
+func (entry *encryptionCacheEntry) touch(slot *encryptionSlot) {
+	atomic.StoreUint64(&slot.used, atomic.AddUint64(&entry.clock, 1))
+}
+
+// find returns the slot of this entry that can be used to encrypt messages
+// with the provided pattern and cipher suite under the provided epoch of
+// public parameters, or nil if there is none. A slot restored from a snapshot
+// can only be used for AES-CTR.
+func (entry *encryptionCacheEntry) find(epoch uint32, pattern Pattern, cipherSuite string) *encryptionSlot {
+	for _, slot := range entry.slots {
+		if slot.pattern != nil && slot.epoch == epoch && pattern.Equals(slot.pattern) && (!slot.restored || cipherSuite == cipherSuiteAES128CTR) {
+			return slot
+		}
+	}
+	return nil
+}
+
+// reference returns the most recently used slot of this entry with a
+// precomputation under the provided epoch of public parameters, or nil if
+// there is none.
+func (entry *encryptionCacheEntry) reference(epoch uint32) *encryptionSlot {
+	var reference *encryptionSlot
+	for _, slot := range entry.slots {
+		if slot.precomputes(epoch) && (reference == nil || atomic.LoadUint64(&slot.used) > atomic.LoadUint64(&reference.used)) {
+			reference = slot
+		}
+	}
+	return reference
+}
+
+// slotFor returns the slot of this entry in which to store the encryption for
+// the provided pattern: a slot already holding that pattern (e.g., under an
+// older epoch of public parameters), an empty slot, a new slot if the entry
+// has fewer than the provided number of slots, or otherwise the least
+// recently used slot. The caller must hold the entry's lock as a writer.
+func (entry *encryptionCacheEntry) slotFor(pattern Pattern, slots int) *encryptionSlot {
+	var victim *encryptionSlot
+	for _, slot := range entry.slots {
+		if slot.pattern == nil || pattern.Equals(slot.pattern) {
+			return slot
+		}
+		if victim == nil || slot.used < victim.used {
+			victim = slot
+		}
+	}
+	if len(entry.slots) < slots {
+		victim = new(encryptionSlot)
+		entry.slots = append(entry.slots, victim)
+	}
+	return victim
+}
+
+// latest returns the newest time encoded in the patterns of this entry's
+// slots, which determines when the entry expires (see WithEncryptionExpiry).
+func (entry *encryptionCacheEntry) latest() time.Time {
+	var latest time.Time
+	for _, slot := range entry.slots {
+		if slot.pattern != nil && slot.timestamp.After(latest) {
+			latest = slot.timestamp
+		}
+	}
+	return latest
+}
+
+// precomputes reports whether this slot has a precomputation under the
+// provided epoch of public parameters.
+func (slot *encryptionSlot) precomputes(epoch uint32) bool {
+	return slot.pattern != nil && !slot.restored && slot.epoch == epoch
+}
+
+// precomputationCopy is a private copy of the precomputation in a slot of an
+// encryption cache entry, along with the pattern and attribute list that it
+// was computed for.
+type precomputationCopy struct {
+	pattern     Pattern
+	attrs       wkdibe.AttributeList
+	precomputed *wkdibe.PreparedAttributeList
+}
+
+// copyPrecomputation returns a copy of the precomputation of the most
+// recently used slot of this entry, which the caller may adjust. It returns
+// nil if no slot has a precomputation under the provided epoch of public
+// parameters, because the entry has not been populated yet, was populated
+// under a different epoch, or was restored from a snapshot. The caller must
+// not hold the lock of any other encryption cache entry, since entries may
+// copy each other's precomputations.
+func (entry *encryptionCacheEntry) copyPrecomputation(epoch uint32) *precomputationCopy {
+	entry.lock.RLock()
+	defer entry.lock.RUnlock()
+
+	slot := entry.reference(epoch)
+	if slot == nil {
+		return nil
+	}
+	precomputed := new(wkdibe.PreparedAttributeList)
+	*precomputed = *slot.precomputed
+	return &precomputationCopy{
+		pattern:     slot.pattern,
+		attrs:       slot.attrs,
+		precomputed: precomputed,
+	}
+}
+
+// encryptionIndex maps each URI prefix to the most recently populated
+// encryptionCacheEntry under that prefix. It allows encryption for a new URI
+// to start from the precomputation of a cached URI sharing the longest prefix
+// with it, instead of preparing the attribute list from scratch.
+type encryptionIndex struct {
+	lock    sync.Mutex
+	entries map[string]*encryptionCacheEntry
+}
+
+func newEncryptionIndex() *encryptionIndex {
+	return &encryptionIndex{
+		entries: make(map[string]*encryptionCacheEntry),
+	}
+}
+
+// nearest returns the indexed entry sharing the longest prefix with the
+// provided URI, or nil if there is no entry for the hierarchy.
+func (index *encryptionIndex) nearest(ns []byte, uri URIPath) *encryptionCacheEntry {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	for i := len(uri); i >= 0; i-- {
+		if entry, ok := index.entries[encryptionCacheKey(ns, uri[:i])]; ok {
+			return entry
+		}
+	}
+	return nil
+}
+
+// insert records entry as the most recently populated entry under every
+// prefix of the provided URI.
+func (index *encryptionIndex) insert(ns []byte, uri URIPath, entry *encryptionCacheEntry) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	for i := 0; i <= len(uri); i++ {
+		index.entries[encryptionCacheKey(ns, uri[:i])] = entry
+	}
+}
+
+// remove drops entry from every prefix of the provided URI under which it is
+// still recorded, so that evicted entries are not kept alive by the index.
+func (index *encryptionIndex) remove(ns []byte, uri URIPath, entry *encryptionCacheEntry) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	for i := 0; i <= len(uri); i++ {
+		key := encryptionCacheKey(ns, uri[:i])
+		if index.entries[key] == entry {
+			delete(index.entries, key)
+		}
+	}
 }
 
 /* Key type identifiers for cache. */
@@ -79,6 +408,7 @@ const (
 	cacheKeyTypeHierarchy = iota
 	cacheKeyTypeEncryption
 	cacheKeyTypeDecryption
+	cacheKeyTypeQualified
 )
 
 // hierarchyCacheKey constructs a key for the cache based on a hierarchy
@@ -110,27 +440,102 @@ func encryptionCacheKey(ns []byte, uri URIPath) string {
 	return b.String()
 }
 
-// decryptionCacheKey constructs a key for the cache based on a ciphertext of
-// an encrypted symmetric key, to look up the cached plaintext in lieu of
-// decryption.
-func decryptionCacheKey(ciphertext []byte) string {
+// decryptionCacheKey constructs a key for the cache based on a hierarchy
+// identifier and a ciphertext of an encrypted symmetric key, to look up the
+// cached plaintext in lieu of decryption. The hierarchy is included so that
+// the entry is accounted to the hierarchy's tenant (see WithTenantBudgets).
+// The ciphertext is included only as a SHA-256 digest, to keep keys short;
+// the entry stores the ciphertext itself, which is compared on each hit.
+func decryptionCacheKey(ns []byte, ciphertext []byte) string {
+	return decryptionDigestKey(ns, sha256.Sum256(ciphertext))
+}
+
+// patternDecryptionCacheKey is like decryptionCacheKey, but the digest also
+// covers the pattern with which the ciphertext is decrypted, so that
+// decrypting a ciphertext with the wrong pattern does not affect the cached
+// decryption for the right one.
+func patternDecryptionCacheKey(ns []byte, pattern Pattern, ciphertext []byte) string {
+	hash := sha256.New()
+	hash.Write(ciphertext)
+	hash.Write(pattern.Marshal())
+
+	var digest [sha256.Size]byte
+	hash.Sum(digest[:0])
+	return decryptionDigestKey(ns, digest)
+}
+
+// decryptionDigestKey constructs a key for the decryption cache based on a
+// hierarchy identifier and a digest identifying the decryption.
+func decryptionDigestKey(ns []byte, digest [sha256.Size]byte) string {
 	var b strings.Builder
 	b.WriteByte(cacheKeyTypeDecryption)
-	b.Write(ciphertext)
+
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], uint32(len(ns)))
+
+	b.Write(buffer[:])
+	b.Write(ns)
+	b.Write(digest[:])
+
+	return b.String()
+}
+
+// qualifiedKeyCacheKey constructs a key for the cache based on a hierarchy
+// identifier, an epoch of its public parameters, and a fully-specified
+// pattern, to look up a secret key qualified to that pattern.
+func qualifiedKeyCacheKey(ns []byte, epoch uint32, pattern Pattern) string {
+	var b strings.Builder
+	b.WriteByte(cacheKeyTypeQualified)
+
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], uint32(len(ns)))
+
+	b.Write(buffer[:])
+	b.Write(ns)
+
+	binary.LittleEndian.PutUint32(buffer[:], epoch)
+	b.Write(buffer[:])
+	b.Write(pattern.Marshal())
+
 	return b.String()
 }
 
+// parseQualifiedKeyPattern extracts the epoch and pattern from a key
+// constructed with qualifiedKeyCacheKey.
+func parseQualifiedKeyPattern(key string) (uint32, Pattern, bool) {
+	keybytes := []byte(key)
+	nslen := binary.LittleEndian.Uint32(keybytes[1:5])
+	epoch := binary.LittleEndian.Uint32(keybytes[5+nslen : 9+nslen])
+	var pattern Pattern
+	if !pattern.Unmarshal(keybytes[9+nslen:]) {
+		return 0, nil, false
+	}
+	return epoch, pattern, true
+}
+
+// cacheKindOf returns the kind of object stored under the provided key.
+func cacheKindOf(key string) CacheKind {
+	switch key[0] {
+	case cacheKeyTypeHierarchy:
+		return CacheKindHierarchy
+	case cacheKeyTypeEncryption:
+		return CacheKindEncryption
+	case cacheKeyTypeDecryption:
+		return CacheKindDecryption
+	default:
+		return CacheKindQualifiedKey
+	}
+}
+
 func parsekey(key string) (keytype byte, content []byte) {
 	keybytes := []byte(key)
 	keytype = keybytes[0]
 	switch keytype {
 	case cacheKeyTypeHierarchy:
 		content = keybytes[1:]
-	case cacheKeyTypeEncryption:
+	case cacheKeyTypeEncryption, cacheKeyTypeDecryption, cacheKeyTypeQualified:
 		nslen := binary.LittleEndian.Uint32(keybytes[1:5])
 		content = keybytes[5 : 5+nslen]
-	case cacheKeyTypeDecryption:
-		content = keybytes[1:]
 	}
 	return
 }
@@ -138,46 +543,321 @@ func parsekey(key string) (keytype byte, content []byte) {
 // NewClientState creates a new ClientState abstraction with the specified
 // abstraction to the key store, algorithm to encode patterns, and memory
 // capacity (in bytes) to cache objects to accelerate JEDI's crypto operations.
-func NewClientState(public PublicInfoReader, keys KeyStoreReader, encoder PatternEncoder, capacity uint64) *ClientState {
+// Additional behavior can be configured by passing ClientOptions. If a Cache
+// is provided with the WithCache option, then capacity is ignored.
+func NewClientState(public PublicInfoReader, keys KeyStoreReader, encoder PatternEncoder, capacity uint64, options ...ClientOption) *ClientState {
 	state := new(ClientState)
 	state.info = public
 	state.store = keys
 	state.encoder = encoder
+	state.loader = &cacheLoader{
+		state: state,
+		live:  make(map[string]interface{}),
+	}
+	state.nearby = newEncryptionIndex()
+	state.subscriptions = newSubscriptionRegistry()
+	state.encryptionSlots = 1
+	for _, option := range options {
+		option(state)
+	}
 
-	state.cache = reqcache.NewLRUCache(capacity,
-		func(ctx context.Context, key interface{}) (interface{}, uint64, error) {
-			keystring := key.(string)
-			keytype, contentbytes := parsekey(keystring)
-			size := uint64(len(keystring))
-			switch keytype {
-			case cacheKeyTypeHierarchy:
-				params, err := state.info.ParamsForHierarchy(ctx, contentbytes)
-				if err != nil {
-					return nil, 0, err
-				}
-				size += uint64(unsafe.Sizeof(*params)) + uint64(uintptr(params.NumAttributes())*unsafe.Sizeof(*bls12381.G1Zero))
-				return (*hierarchyCacheEntry)(params), size, nil
-			case cacheKeyTypeEncryption:
-				entry := new(encryptionCacheEntry)
-				/*
-				 * Since these cache entries are mutable anyway, and have an
-				 * internal lock to support that, we just have the caller
-				 * acquire the lock and perform the initialization.
-				 */
-				size += uint64(unsafe.Sizeof(*entry) + unsafe.Sizeof(*entry.encryptedKey) + unsafe.Sizeof(*entry.precomputed))
-				return entry, size, nil
-			case cacheKeyTypeDecryption:
-				entry := new(decryptionCacheEntry)
-				/*
-				 * We can't populate this type of entry here, because we need
-				 * the URI and time to be able to decrypt the ciphertext.
-				 */
-				size += uint64(unsafe.Sizeof(*entry))
-				return entry, size, nil
-			default:
-				panic(fmt.Sprintf("Unknown cache key type: %v", keytype))
-			}
-		}, nil)
+	if state.lockedKeys != 0 {
+		state.keys = newKeyPool(state.lockedKeys)
+	}
+
+	if state.tenants != nil {
+		state.cache = newTenantCache(*state.tenants, capacity, state.cacheEntrySize)
+	} else if state.cache == nil {
+		state.cache = NewLRUCache(CacheConfig{Capacity: capacity})
+	}
+	if state.encryptionExpiry || state.decryptionTTL != 0 {
+		state.expiry = newExpiryQueue()
+	}
 
 	return state
 }
+
+// cacheLoader is the CacheLoader for a ClientState. It keeps track of the
+// objects that the ClientState has in the cache, so that they can be evicted
+// when the ClientState is closed.
+type cacheLoader struct {
+	state  *ClientState
+	lock   sync.Mutex
+	live   map[string]interface{}
+	closed int32
+}
+
+// Load implements the CacheLoader interface.
+func (loader *cacheLoader) Load(ctx context.Context, key string) (interface{}, uint64, error) {
+	state := loader.state
+	if missed, ok := ctx.Value(cacheMissKey{}).(*bool); ok {
+		*missed = true
+	}
+	value, err := state.load(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	loader.lock.Lock()
+	if atomic.LoadInt32(&loader.closed) != 0 {
+		loader.lock.Unlock()
+		state.wipeCacheEntry(value)
+		return nil, 0, ErrClientStateClosed
+	}
+	loader.live[key] = value
+	loader.lock.Unlock()
+
+	size := state.cacheEntrySize(key, value)
+	if state.observer != nil {
+		state.observer.CacheInsert(cacheKindOf(key), size)
+	}
+	return value, size, nil
+}
+
+// Evicted implements the CacheLoader interface. It removes evicted encryption
+// entries from the index of nearby URIs, cancels their expiry, reports the
+// evictions to the observer, if there is one, and wipes the key material in
+// the evicted entries.
+func (loader *cacheLoader) Evicted(key string, value interface{}) {
+	state := loader.state
+	if state.expiry != nil {
+		state.expiry.cancel(key, value)
+	}
+	if state.observer != nil {
+		state.observer.CacheEvict(cacheKindOf(key), state.cacheEntrySize(key, value))
+	}
+
+	if entry, ok := value.(*encryptionCacheEntry); ok {
+		_, ns := parsekey(key)
+
+		entry.lock.RLock()
+		uriPath := entry.uriPath
+		entry.lock.RUnlock()
+
+		if uriPath != nil {
+			state.nearby.remove(ns, uriPath, entry)
+		}
+	}
+
+	loader.lock.Lock()
+	if loader.live[key] == value {
+		delete(loader.live, key)
+	}
+	loader.lock.Unlock()
+
+	state.wipeCacheEntry(value)
+}
+
+// Close evicts all of the objects that the ClientState has in its cache, and
+// wipes the key material in them. If the ClientState was configured with
+// WithLockedMemory, its locked memory is wiped and unlocked. The ClientState
+// must not be used after it is closed; operations on it fail with
+// ErrClientStateClosed.
+func (state *ClientState) Close() {
+	loader := state.loader
+	loader.lock.Lock()
+	atomic.StoreInt32(&loader.closed, 1)
+	keys := make([]string, 0, len(loader.live))
+	for key := range loader.live {
+		keys = append(keys, key)
+	}
+	loader.lock.Unlock()
+
+	for _, key := range keys {
+		state.cache.Evict(loader, cacheKindOf(key), key)
+	}
+	if state.keys != nil {
+		state.keys.close()
+	}
+}
+
+// InvalidateHierarchy evicts the cached public parameters of a hierarchy,
+// along with the cached encryption state and qualified keys for it, so that
+// they are read again from the PublicInfoReader and KeyStoreReader when they
+// are next needed. It should be called when the public parameters of the
+// hierarchy change, for example when a new epoch is added or an old one is
+// retired. Cached decryptions of individual ciphertexts are kept, but are
+// only used while the epoch they were produced under is accepted.
+func (state *ClientState) InvalidateHierarchy(hierarchy []byte) {
+	loader := state.loader
+	loader.lock.Lock()
+	var keys []string
+	for key := range loader.live {
+		keytype, ns := parsekey(key)
+		if keytype != cacheKeyTypeDecryption && bytes.Equal(ns, hierarchy) {
+			keys = append(keys, key)
+		}
+	}
+	loader.lock.Unlock()
+
+	for _, key := range keys {
+		state.cache.Evict(loader, cacheKindOf(key), key)
+	}
+}
+
+// load creates the cache entry for the provided key, when it is not found in
+// the cache.
+func (state *ClientState) load(ctx context.Context, keystring string) (interface{}, error) {
+	keytype, contentbytes := parsekey(keystring)
+	switch keytype {
+	case cacheKeyTypeHierarchy:
+		return state.loadParamEpochs(ctx, contentbytes)
+	case cacheKeyTypeEncryption:
+		/*
+		 * Since these cache entries are mutable anyway, and have an internal
+		 * lock to support that, we just have the caller acquire the lock and
+		 * perform the initialization.
+		 */
+		return new(encryptionCacheEntry), nil
+	case cacheKeyTypeDecryption:
+		/*
+		 * We can't populate this type of entry here, because we need the URI
+		 * and time to be able to decrypt the ciphertext. But creating the
+		 * entry means that the ciphertext will be decrypted, so make sure
+		 * that it is admitted first.
+		 */
+		if err := state.admitColdDecryption(ctx); err != nil {
+			return nil, err
+		}
+		return new(decryptionCacheEntry), nil
+	case cacheKeyTypeQualified:
+		epoch, pattern, ok := parseQualifiedKeyPattern(keystring)
+		if !ok {
+			return nil, errors.New("malformed pattern in cache key")
+		}
+		var params *wkdibe.Params
+		var secretKey *wkdibe.SecretKey
+		var err error
+		if versioned, ok := state.store.(VersionedKeyStoreReader); ok {
+			params, secretKey, err = versioned.KeyForPatternInEpoch(ctx, contentbytes, epoch, pattern)
+		} else {
+			params, secretKey, err = state.store.KeyForPattern(ctx, contentbytes, pattern)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if secretKey == nil {
+			return nil, ErrKeyNotFound
+		}
+		entry := new(qualifiedKeyCacheEntry)
+		start := time.Now()
+		entry.key = wkdibe.NonDelegableQualifyKey(params, secretKey, pattern.ToAttrs())
+		state.observeOperation(OperationQualify, start)
+		return entry, nil
+	default:
+		panic(fmt.Sprintf("Unknown cache key type: %v", keytype))
+	}
+}
+
+// loadParamEpochs creates the cache entry for the public parameters of a
+// hierarchy, reading all of their epochs if the PublicInfoReader is
+// versioned.
+func (state *ClientState) loadParamEpochs(ctx context.Context, hierarchy []byte) (*hierarchyCacheEntry, error) {
+	versioned, ok := state.info.(VersionedPublicInfoReader)
+	if !ok {
+		params, err := state.info.ParamsForHierarchy(ctx, hierarchy)
+		if err != nil {
+			return nil, err
+		}
+		return &hierarchyCacheEntry{epochs: []ParamEpoch{{Params: params}}}, nil
+	}
+
+	epochs, err := versioned.ParamEpochsForHierarchy(ctx, hierarchy)
+	if err != nil {
+		return nil, err
+	}
+	if len(epochs) == 0 {
+		return nil, errors.New("hierarchy has no public parameters")
+	}
+	entry := &hierarchyCacheEntry{epochs: append([]ParamEpoch(nil), epochs...)}
+	for i := range entry.epochs {
+		if entry.epochs[i].Params == nil {
+			return nil, fmt.Errorf("epoch %d of hierarchy has no public parameters", entry.epochs[i].Epoch)
+		}
+	}
+	sort.Slice(entry.epochs, func(i, j int) bool {
+		return entry.epochs[i].Epoch > entry.epochs[j].Epoch
+	})
+	return entry, nil
+}
+
+// cacheEntryOverhead approximates the bookkeeping for each object in the
+// cache, beyond its key and value: the entry in the cacheLoader's map of live
+// entries, and the entry, list element, and key in the default LRU cache.
+const cacheEntryOverhead = unsafe.Sizeof("") + unsafe.Sizeof(interface{}(nil)) + unsafe.Sizeof(lruCacheKey{}) + unsafe.Sizeof(reqcache.LRUCacheEntry{}) + unsafe.Sizeof(list.Element{})
+
+// cacheEntrySize estimates the memory, in bytes, used by a cache entry with
+// the provided key and value once it is populated. The estimate depends only
+// on the key and on the types in the value, so that it is the same when the
+// entry is inserted into the cache and when it is evicted.
+func (state *ClientState) cacheEntrySize(keystring string, value interface{}) uint64 {
+	size := uint64(len(keystring)) + uint64(cacheEntryOverhead)
+	switch entry := value.(type) {
+	case *hierarchyCacheEntry:
+		size += uint64(unsafe.Sizeof(*entry))
+		for i := range entry.epochs {
+			params := entry.epochs[i].Params
+			size += uint64(unsafe.Sizeof(entry.epochs[i]) + unsafe.Sizeof(*params) + uintptr(params.NumAttributes())*unsafe.Sizeof(*bls12381.G1Zero))
+		}
+	case *encryptionCacheEntry:
+		/*
+		 * The URI path and the pattern in each slot hold a copy of the URI's
+		 * components, which are in the key after the hierarchy, with a slice
+		 * header for each component. The attribute list in each slot has an
+		 * entry, with a hashed integer, for each component of the pattern.
+		 * The entry is sized for the number of slots that it may grow to.
+		 */
+		_, ns := parsekey(keystring)
+		uriBytes := uint64(len(keystring) - 5 - len(ns))
+		components := uint64(state.patternLength())
+		sliceHeader := uint64(unsafe.Sizeof([]byte(nil)))
+		size += uint64(unsafe.Sizeof(*entry)) + uriBytes + components*sliceHeader
+
+		var slot *encryptionSlot
+		perSlot := uint64(unsafe.Sizeof(slot) + unsafe.Sizeof(*slot) + unsafe.Sizeof(keyMaterial{}) + unsafe.Sizeof(*slot.encryptedKey) + unsafe.Sizeof(*slot.precomputed))
+		perAttribute := uint64(unsafe.Sizeof(wkdibe.AttributeIndex(0)) + unsafe.Sizeof((*big.Int)(nil)) + unsafe.Sizeof(big.Int{}) + sha256.Size)
+		perSlot += uriBytes + components*(sliceHeader+perAttribute)
+		size += uint64(state.encryptionSlots) * perSlot
+	case *decryptionCacheEntry:
+		size += uint64(unsafe.Sizeof(*entry) + unsafe.Sizeof(keyMaterial{}) + uintptr(EncryptedKeySize))
+	case *qualifiedKeyCacheEntry:
+		size += uint64(unsafe.Sizeof(*entry) + unsafe.Sizeof(*entry.key))
+	}
+	return size
+}
+
+// cacheMissKey is the context key under which cacheGet asks the loader to
+// record that the lookup missed in the cache.
+type cacheMissKey struct{}
+
+// cacheGet looks up an entry in the cache, loading it if necessary, and
+// reports whether it was found to the observer, if there is one. Expired
+// entries are evicted first. It fails if the ClientState has been closed.
+func (state *ClientState) cacheGet(ctx context.Context, keystring string) (interface{}, error) {
+	if atomic.LoadInt32(&state.loader.closed) != 0 {
+		return nil, ErrClientStateClosed
+	}
+	state.ExpireEntries()
+
+	kind := cacheKindOf(keystring)
+	if state.observer == nil {
+		return state.cache.Get(ctx, state.loader, kind, keystring)
+	}
+
+	missed := false
+	value, err := state.cache.Get(context.WithValue(ctx, cacheMissKey{}, &missed), state.loader, kind, keystring)
+	if missed {
+		state.observer.CacheMiss(kind)
+	} else {
+		state.observer.CacheHit(kind)
+	}
+	return value, err
+}
+
+// observeOperation reports a cryptographic operation that began at start to
+// the observer, if there is one.
+func (state *ClientState) observeOperation(op CryptoOperation, start time.Time) {
+	if state.observer != nil {
+		state.observer.CryptoOperation(op, time.Since(start))
+	}
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Command jedi-migrate re-encrypts a corpus of stored JEDI ciphertexts under
+// new hierarchy parameters, for example after rotating a hierarchy's master
+// key.
+//
+// The corpus is read as JSON lines, one item per line, each with the fields
+// "id", "uri", "timestamp" (RFC 3339), and "ciphertext" (base64). Migrated
+// items are written in the same format. Keys for the old hierarchy are read
+// from files containing marshalled JEDI delegations, and the parameters for
+// the new hierarchy are read from a file containing marshalled WKD-IBE
+// parameters.
+//
+// Progress is recorded in a checkpoint file, so that an interrupted migration
+// can be resumed by running the same command again.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+	jedi "github.com/ucbrise/jedi-protocol-go"
+)
+
+// corpusItem is the JSON representation of a jedi.MigrationItem.
+type corpusItem struct {
+	ID         string    `json:"id"`
+	URI        string    `json:"uri"`
+	Timestamp  time.Time `json:"timestamp"`
+	Ciphertext []byte    `json:"ciphertext"`
+}
+
+// corpusReader is a jedi.MigrationSource that reads JSON lines.
+type corpusReader struct {
+	decoder *json.Decoder
+}
+
+func (cr *corpusReader) Next(ctx context.Context) (*jedi.MigrationItem, error) {
+	var item corpusItem
+	if err := cr.decoder.Decode(&item); err != nil {
+		return nil, err
+	}
+	return &jedi.MigrationItem{
+		ID:         item.ID,
+		URI:        item.URI,
+		Timestamp:  item.Timestamp,
+		Ciphertext: item.Ciphertext,
+	}, nil
+}
+
+// corpusWriter is a jedi.MigrationSink that writes JSON lines.
+type corpusWriter struct {
+	file    *os.File
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (cw *corpusWriter) Put(ctx context.Context, item *jedi.MigrationItem) error {
+	return cw.encoder.Encode(&corpusItem{
+		ID:         item.ID,
+		URI:        item.URI,
+		Timestamp:  item.Timestamp,
+		Ciphertext: item.Ciphertext,
+	})
+}
+
+// sync flushes buffered output to stable storage and returns the size of the
+// output file.
+func (cw *corpusWriter) sync() (int64, error) {
+	if err := cw.buffer.Flush(); err != nil {
+		return 0, err
+	}
+	if err := cw.file.Sync(); err != nil {
+		return 0, err
+	}
+	return cw.file.Seek(0, io.SeekCurrent)
+}
+
+// delegationKeyStore is a jedi.KeyStoreReader backed by a set of delegations.
+type delegationKeyStore struct {
+	delegations []*jedi.Delegation
+}
+
+func (dks *delegationKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern jedi.Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	for _, delegation := range dks.delegations {
+		if string(delegation.Hierarchy) != string(hierarchy) {
+			continue
+		}
+		for i, delegated := range delegation.Patterns {
+			if len(delegated) == len(pattern) && delegated.Matches(pattern) {
+				return delegation.Params, delegation.Keys[i], nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+func (dks *delegationKeyStore) ParamsForHierarchy(ctx context.Context, hierarchy []byte) (*wkdibe.Params, error) {
+	for _, delegation := range dks.delegations {
+		if string(delegation.Hierarchy) == string(hierarchy) {
+			return delegation.Params, nil
+		}
+	}
+	return nil, fmt.Errorf("no delegation for hierarchy %s", hierarchy)
+}
+
+// paramsReader is a jedi.PublicInfoReader for a single hierarchy.
+type paramsReader struct {
+	params *wkdibe.Params
+}
+
+func (pr *paramsReader) ParamsForHierarchy(ctx context.Context, hierarchy []byte) (*wkdibe.Params, error) {
+	return pr.params, nil
+}
+
+// noKeys is a jedi.KeyStoreReader with no keys; the new hierarchy is only
+// used for encryption, which does not require any secret keys.
+type noKeys struct{}
+
+func (nk noKeys) KeyForPattern(ctx context.Context, hierarchy []byte, pattern jedi.Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	return nil, nil, nil
+}
+
+func loadDelegations(filenames string) (*delegationKeyStore, error) {
+	store := new(delegationKeyStore)
+	for _, filename := range strings.Split(filenames, ",") {
+		marshalled, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		delegation := new(jedi.Delegation)
+		if !delegation.Unmarshal(marshalled) {
+			return nil, fmt.Errorf("%s does not contain a valid delegation", filename)
+		}
+		store.delegations = append(store.delegations, delegation)
+	}
+	return store, nil
+}
+
+func loadParams(filename string) (*wkdibe.Params, error) {
+	marshalled, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	params := new(wkdibe.Params)
+	if !params.Unmarshal(marshalled, true, true) {
+		return nil, fmt.Errorf("%s does not contain valid parameters", filename)
+	}
+	return params, nil
+}
+
+// readCheckpoint returns the position and output size recorded in the
+// checkpoint file, or zeros if there is no checkpoint.
+func readCheckpoint(filename string) (int64, int64, error) {
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("malformed checkpoint file %s", filename)
+	}
+	position, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return position, size, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint file.
+func writeCheckpoint(filename string, position int64, size int64) error {
+	temporary := filename + ".tmp"
+	contents := fmt.Sprintf("%d %d\n", position, size)
+	if err := os.WriteFile(temporary, []byte(contents), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, filename)
+}
+
+func run() error {
+	oldDelegations := flag.String("old-delegations", "", "comma-separated files with delegations for the old hierarchy")
+	oldHierarchy := flag.String("old-hierarchy", "", "identifier of the old hierarchy")
+	newParams := flag.String("new-params", "", "file with the parameters of the new hierarchy")
+	newHierarchy := flag.String("new-hierarchy", "", "identifier of the new hierarchy (defaults to the old one)")
+	maxURILength := flag.Int("max-uri-length", 14, "maximum URI length supported by the pattern encoding")
+	input := flag.String("in", "", "file with the corpus to migrate")
+	output := flag.String("out", "", "file to which to write the migrated corpus")
+	checkpoint := flag.String("checkpoint", "", "checkpoint file (defaults to the output file with a .checkpoint suffix)")
+	interval := flag.Int64("checkpoint-interval", 1000, "number of items between checkpoints")
+	capacity := flag.Uint64("cache-capacity", 1<<26, "capacity (in bytes) of each client state's cache")
+	legacy := flag.Bool("legacy-key-derivation", false, "decrypt the corpus with the key derivation and message format of older JEDI versions")
+	flag.Parse()
+
+	if *oldDelegations == "" || *oldHierarchy == "" || *newParams == "" || *input == "" || *output == "" {
+		flag.Usage()
+		return errors.New("missing required flags")
+	}
+	if *newHierarchy == "" {
+		*newHierarchy = *oldHierarchy
+	}
+	if *checkpoint == "" {
+		*checkpoint = *output + ".checkpoint"
+	}
+
+	keys, err := loadDelegations(*oldDelegations)
+	if err != nil {
+		return err
+	}
+	params, err := loadParams(*newParams)
+	if err != nil {
+		return err
+	}
+
+	encoder := jedi.NewDefaultPatternEncoder(*maxURILength)
+	var fromOptions []jedi.ClientOption
+	if *legacy {
+		fromOptions = append(fromOptions, jedi.WithLegacyKeyDerivation(), jedi.WithUnversionedMessages())
+	}
+	from := jedi.NewClientState(keys, keys, encoder, *capacity, fromOptions...)
+	to := jedi.NewClientState(&paramsReader{params: params}, noKeys{}, encoder, *capacity)
+
+	/* Resume from the checkpoint, discarding output written after it. */
+	resume, size, err := readCheckpoint(*checkpoint)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err = out.Truncate(size); err != nil {
+		return err
+	}
+	if _, err = out.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+
+	writer := &corpusWriter{file: out, buffer: bufio.NewWriter(out)}
+	writer.encoder = json.NewEncoder(writer.buffer)
+
+	config := &jedi.MigrationConfig{
+		From:          from,
+		FromHierarchy: []byte(*oldHierarchy),
+		To:            to,
+		ToHierarchy:   []byte(*newHierarchy),
+		Resume:        resume,
+		Checkpoint: func(position int64) error {
+			size, err := writer.sync()
+			if err != nil {
+				return err
+			}
+			return writeCheckpoint(*checkpoint, position, size)
+		},
+		CheckpointInterval: *interval,
+	}
+
+	reader := &corpusReader{decoder: json.NewDecoder(bufio.NewReader(in))}
+	report, err := jedi.Migrate(context.Background(), config, reader, writer)
+	if report != nil {
+		for _, failure := range report.Failures {
+			fmt.Fprintf(os.Stderr, "item %d (%s): %v\n", failure.Position, failure.ID, failure.Err)
+		}
+		fmt.Fprintf(os.Stderr, "migrated %d items, %d failed, position %d\n", report.Migrated, len(report.Failures), report.Position)
+	}
+	if err != nil {
+		return err
+	}
+	if len(report.Failures) != 0 {
+		return fmt.Errorf("%d items could not be migrated", len(report.Failures))
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -90,3 +90,46 @@ func TestDelegationURIPrefix(t *testing.T) {
 func TestDelegationFullURI(t *testing.T) {
 	helperTestDelegation(t, "a/b/c/d", time.Unix(1565119330, 0), time.Unix(1565219330, 0))
 }
+
+func TestDelegationUnmarshalTrusted(t *testing.T) {
+	ctx := context.Background()
+	_, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+
+	delegation, err := Delegate(ctx, store, encoder, TestHierarchy, "a/b/c/*", time.Unix(1565119330, 0), time.Unix(1565219330, 0), DecryptPermission)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marshalled := delegation.Marshal()
+	trusted := new(Delegation)
+	if !trusted.UnmarshalTrusted(marshalled) {
+		t.Fatal("Could not unmarshal trusted delegation")
+	}
+	if len(trusted.Patterns) != len(delegation.Patterns) {
+		t.Fatal("Unmarshalled delegation has the wrong number of patterns")
+	}
+	for i, pattern := range delegation.Patterns {
+		if !pattern.Equals(trusted.Patterns[i]) {
+			t.Fatal("Unmarshalled delegation has the wrong patterns")
+		}
+	}
+}
+
+func TestDelegationUnmarshalTampered(t *testing.T) {
+	ctx := context.Background()
+	_, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+
+	delegation, err := Delegate(ctx, store, encoder, TestHierarchy, "a/b/c/*", time.Unix(1565119330, 0), time.Unix(1565219330, 0), DecryptPermission)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Corrupt a group element in the last key of the delegation. */
+	marshalled := delegation.Marshal()
+	marshalled[len(marshalled)-2] ^= 0x01
+	if new(Delegation).Unmarshal(marshalled) {
+		t.Fatal("Unmarshalled a delegation with an invalid group element")
+	}
+}
@@ -33,18 +33,94 @@
 package jedi
 
 import (
+	"bytes"
 	"context"
 	"crypto/aes"
+	"encoding/binary"
 	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/ucbrise/jedi-pairing/lang/go/cryptutils"
 	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
 )
 
-// EncryptedKeySize the size (in bytes) of the WKD-IBE ciphertext of the
-// symmetric key at the beginning of each JEDI ciphertext.
-var EncryptedKeySize = wkdibe.CiphertextMarshalledLength(true)
+// ParamEpochLength is the size (in bytes) of the epoch of public parameters
+// at the beginning of the encrypted key in each JEDI ciphertext.
+const ParamEpochLength = 4
+
+// EncryptedKeySize the size (in bytes) of the encrypted symmetric key at the
+// beginning of each JEDI ciphertext. It consists of the epoch of the public
+// parameters that the key was encrypted under, in little-endian byte order,
+// followed by the WKD-IBE ciphertext of the key.
+var EncryptedKeySize = ParamEpochLength + wkdibe.CiphertextMarshalledLength(true)
+
+// ErrParamEpochNotAccepted is returned when decrypting a message produced
+// under an epoch of public parameters that is unknown or has been retired.
+var ErrParamEpochNotAccepted = errors.New("message was encrypted under public parameters that are unknown or retired")
+
+// marshalEncryptedKey writes the epoch and WKD-IBE ciphertext of a symmetric
+// key into encryptedKey, which must be EncryptedKeySize bytes long.
+func marshalEncryptedKey(encryptedKey []byte, epoch uint32, ciphertext *wkdibe.Ciphertext) {
+	binary.LittleEndian.PutUint32(encryptedKey[:ParamEpochLength], epoch)
+	copy(encryptedKey[ParamEpochLength:], ciphertext.Marshal(true))
+}
+
+// encryptedKeyEpoch returns the epoch of public parameters recorded in an
+// encrypted key, which must be EncryptedKeySize bytes long.
+func encryptedKeyEpoch(encryptedKey []byte) uint32 {
+	return binary.LittleEndian.Uint32(encryptedKey[:ParamEpochLength])
+}
+
+// messageKeySize returns the size of the encrypted key at the beginning of the
+// messages that the ClientState encrypts and decrypts. With unversioned
+// messages, the epoch is omitted, as it was by older versions of JEDI, and
+// messages are encrypted and decrypted under epoch 0.
+func (state *ClientState) messageKeySize() int {
+	if state.unversionedMessages {
+		return EncryptedKeySize - ParamEpochLength
+	}
+	return EncryptedKeySize
+}
+
+// expandMessageKey returns the encrypted key at the beginning of a message,
+// in the form used internally, which includes the epoch.
+func (state *ClientState) expandMessageKey(messageKey []byte) []byte {
+	if !state.unversionedMessages {
+		return messageKey
+	}
+	encryptedKey := make([]byte, EncryptedKeySize)
+	copy(encryptedKey[ParamEpochLength:], messageKey)
+	return encryptedKey
+}
+
+// encryptionParamEpoch returns the epoch of public parameters, among those
+// in the provided cache entry, under which new messages are encrypted.
+func (state *ClientState) encryptionParamEpoch(entry *hierarchyCacheEntry) (*ParamEpoch, error) {
+	if !state.unversionedMessages {
+		return entry.newest(), nil
+	}
+	epoch, ok := entry.accepted(0, time.Now())
+	if !ok {
+		return nil, ErrParamEpochNotAccepted
+	}
+	return epoch, nil
+}
+
+// acceptedParamEpoch returns the epoch of public parameters recorded in
+// encryptedKey, or ErrParamEpochNotAccepted if messages produced under it
+// may not be decrypted.
+func (state *ClientState) acceptedParamEpoch(ctx context.Context, hierarchy []byte, encryptedKey []byte) (*ParamEpoch, error) {
+	entryInt, err := state.cacheGet(ctx, hierarchyCacheKey(hierarchy))
+	if err != nil {
+		return nil, err
+	}
+	epoch, ok := entryInt.(*hierarchyCacheEntry).accepted(encryptedKeyEpoch(encryptedKey), time.Now())
+	if !ok {
+		return nil, ErrParamEpochNotAccepted
+	}
+	return epoch, nil
+}
 
 // Encrypt encrypts a message using JEDI, reading from and mutating the
 // ClientState instance on which the function is invoked. The "timestamp"
@@ -53,142 +129,327 @@ var EncryptedKeySize = wkdibe.CiphertextMarshalledLength(true)
 // combination, but for a single URI you should try to move chronologically
 // in time for the best performance.
 func (state *ClientState) Encrypt(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, message []byte) ([]byte, error) {
+	uriPath, pattern, err := state.encodePattern(uri, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return state.encryptWithPattern(ctx, hierarchy, uriPath, pattern, timestamp, message)
+}
+
+// encodePattern parses a URI and time, and encodes them into the pattern used
+// to encrypt and decrypt messages for that URI and time.
+func (state *ClientState) encodePattern(uri string, timestamp time.Time) (URIPath, Pattern, error) {
 	var err error
 
 	/* Parse the URI. */
 	var uriPath URIPath
 	if uriPath, err = ParseURI(uri); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	/* Parse the current time. */
 	var timePath TimePath
 	if timePath, err = ParseTime(timestamp); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	/* Encode the pattern based on the URI path and time path. */
 	pattern := state.encoder.Encode(uriPath, timePath, PatternTypeDecryption)
+	return uriPath, pattern, nil
+}
 
-	return state.EncryptWithPattern(ctx, hierarchy, uriPath, pattern, message)
+// patternLength returns the number of components in the patterns produced by
+// the ClientState's PatternEncoder. Unless the encoder reports it, it is
+// learned by encoding a URI and time when it is first needed, rather than when
+// the ClientState is created, since an encoder may not expect to be called
+// before the application is ready.
+func (state *ClientState) patternLength() int {
+	state.patternOnce.Do(func() {
+		if encoder, ok := state.encoder.(PatternLengthEncoder); ok {
+			state.patternLen = encoder.PatternLength()
+			return
+		}
+		uriPath, _ := ParseURI("jedi")
+		timePath, _ := ParseTime(time.Now())
+		state.patternLen = len(state.encoder.Encode(uriPath, timePath, PatternTypeDecryption))
+	})
+	return state.patternLen
+}
+
+// checkPattern returns an error if the provided pattern, which may come from
+// an untrusted party, does not have the length of the patterns produced by
+// the ClientState's PatternEncoder. Such a pattern cannot match any key in
+// the hierarchy, and would otherwise be passed to WKD-IBE with attribute
+// indices out of range.
+func (state *ClientState) checkPattern(pattern Pattern) error {
+	if len(pattern) != state.patternLength() {
+		return errors.New("pattern has invalid length")
+	}
+	return nil
 }
 
 // EncryptWithPattern is like Encrypt, but requires the Pattern to already be
 // formed. This is useful if you've already parsed the URI, or are working with
-// the URI components directly.
+// the URI components directly. The pattern is assumed to be for the current
+// time when deciding when to expire its cached encryption entry.
 func (state *ClientState) EncryptWithPattern(ctx context.Context, hierarchy []byte, uriPath URIPath, pattern Pattern, message []byte) ([]byte, error) {
+	return state.encryptWithPattern(ctx, hierarchy, uriPath, pattern, time.Now(), message)
+}
+
+// encryptWithPattern is like EncryptWithPattern, but also accepts the time
+// that the pattern was encoded from.
+func (state *ClientState) encryptWithPattern(ctx context.Context, hierarchy []byte, uriPath URIPath, pattern Pattern, timestamp time.Time, message []byte) ([]byte, error) {
 	var err error
 
-	/* Get WKD-IBE public parameters for the specified namespace. */
-	var paramsInt interface{}
-	if paramsInt, err = state.cache.Get(ctx, hierarchyCacheKey(hierarchy)); err != nil {
+	keySize := state.messageKeySize()
+	encrypted := make([]byte, keySize+aes.BlockSize+len(message))
+
+	/* Obtain a symmetric key and its WKD-IBE ciphertext for this pattern. */
+	encryptedKey := encrypted[:keySize]
+	if keySize != EncryptedKeySize {
+		encryptedKey = make([]byte, EncryptedKeySize)
+	}
+	var key [AESKeySize]byte
+	defer zeroBytes(key[:])
+	if key, err = state.encryptionKey(ctx, hierarchy, uriPath, pattern, timestamp, cipherSuiteAES128CTR, encryptedKey); err != nil {
 		return nil, err
 	}
-	params := (*wkdibe.Params)(paramsInt.(*hierarchyCacheEntry))
+	copy(encrypted[:keySize], encryptedKey[EncryptedKeySize-keySize:])
 
-	/* Get the cached state (if any) for this URI. */
-	var entryInt interface{}
-	if entryInt, err = state.cache.Get(ctx, encryptionCacheKey(hierarchy, uriPath)); err != nil {
+	/* Encrypt the message with the symmetric key. */
+	if err = aesCTREncryptInMem(encrypted[keySize:], message, key[:]); err != nil {
 		return nil, err
 	}
-	entry := entryInt.(*encryptionCacheEntry)
 
+	return encrypted, nil
+}
+
+// encryptionKey returns the symmetric key, for the provided cipher suite, to
+// use to encrypt messages with the provided URI and pattern, and writes the
+// WKD-IBE ciphertext of that key into encryptedKey, which must be
+// EncryptedKeySize bytes long. The key and its ciphertext are cached, so that
+// they are reused for subsequent messages with the same pattern. The
+// timestamp is the time encoded in the pattern. The caller should wipe the
+// returned key once it is done with it.
+func (state *ClientState) encryptionKey(ctx context.Context, hierarchy []byte, uriPath URIPath, pattern Pattern, timestamp time.Time, cipherSuite string, encryptedKey []byte) ([AESKeySize]byte, error) {
+	var err error
 	var key [AESKeySize]byte
-	encrypted := make([]byte, EncryptedKeySize+aes.BlockSize+len(message))
 
 	/*
-	 * Acquire the entry's lock as a reader, optimistically assuming that our
-	 * URI and time are identical to the cached ones.
+	 * Get the newest WKD-IBE public parameters for the specified namespace.
+	 */
+	var paramsInt interface{}
+	if paramsInt, err = state.cacheGet(ctx, hierarchyCacheKey(hierarchy)); err != nil {
+		return key, err
+	}
+	var epoch *ParamEpoch
+	if epoch, err = state.encryptionParamEpoch(paramsInt.(*hierarchyCacheEntry)); err != nil {
+		return key, err
+	}
+
+	/* Get the cached state (if any) for this URI. */
+	cacheKey := encryptionCacheKey(hierarchy, uriPath)
+	var entryInt interface{}
+	if entryInt, err = state.cacheGet(ctx, cacheKey); err != nil {
+		return key, err
+	}
+	entry := entryInt.(*encryptionCacheEntry)
+
+	/*
+	 * Acquire the entry's lock as a reader, optimistically assuming that a
+	 * slot of the entry already has our pattern.
 	 */
 	entry.lock.RLock()
 
-	/* Check if our pattern matches the one in the cache. */
-	identical := pattern.Equals(entry.pattern)
+	if entry.wiped {
+		/*
+		 * The entry was evicted, and its key wiped, after we looked it up.
+		 * Looking it up again could have the same result if the cache is
+		 * under pressure, so encrypt without the cache instead.
+		 */
+		entry.lock.RUnlock()
+		return state.encryptUncached(epoch, hierarchy, pattern, cipherSuite, encryptedKey)
+	}
 
 	/*
-	 * If they match, then save the key so we can reuse it for this
-	 * encryption.
+	 * Check if our pattern matches one in the cache, with a key encrypted
+	 * under the newest public parameters. If so, then save the key so we can
+	 * reuse it for this encryption.
 	 */
-	if identical {
-		copy(key[:], entry.key[:])
-		copy(encrypted[:EncryptedKeySize], entry.encryptedKey.Marshal(true))
+	slot := entry.find(epoch.Epoch, pattern, cipherSuite)
+	if slot != nil {
+		entry.touch(slot)
+		key, err = state.suiteKey(slot.material, hierarchy, pattern, cipherSuite)
+		marshalEncryptedKey(encryptedKey, slot.epoch, slot.encryptedKey)
 	}
 
 	entry.lock.RUnlock()
 
-	if !identical {
+	if slot == nil {
 		/*
-		 * If they aren't identical to the cached ones, then we can't use the
-		 * cached key directly---we must either compute the encryption from
-		 * scratch and cache the values, or, if there's already a cached value,
-		 * perform precomputation with adjustment. Acquire the entry's lock as
-		 * a writer in preparation for this.
+		 * If there's no such slot, then we must compute the encryption,
+		 * adjusting a cached precomputation if there is one, and store it
+		 * in a slot of the entry. Copy the precomputation of a nearby URI
+		 * (e.g., a sibling) first, in case the entry has none to adjust;
+		 * that URI's entry must not be locked while we hold this one's lock,
+		 * or two neighbours encrypting at once could deadlock. Then acquire
+		 * the entry's lock as a writer.
 		 */
-		entry.lock.Lock()
+		var nearby *precomputationCopy
+		if nearest := state.nearby.nearest(hierarchy, uriPath); nearest != nil && nearest != entry {
+			nearby = nearest.copyPrecomputation(epoch.Epoch)
+		}
 
-		updateEntryAndEncrypt := false
-		var attrs wkdibe.AttributeList
+		entry.lock.Lock()
 
-		if entry.pattern == nil {
-			/*
-			 * It's a new entry, so we need to encrypt from scratch. Obtain the
-			 * intermediate value (the precomputation) and store it in the
-			 * entry for later use.
-			 */
-			attrs = pattern.ToAttrs()
-			entry.precomputed = wkdibe.PrepareAttributeList(params, attrs)
-			updateEntryAndEncrypt = true
-		} else {
-			/*
-			 * It's an existing value with a cached precomputation. We can't
-			 * use that precomputation directly in our encryption, but we can
-			 * use it to compute our new precomputation faster.
-			 */
-			attrs, identical = pattern.ToAttrsWithReference(entry.pattern, entry.attrs)
+		if entry.wiped {
+			entry.lock.Unlock()
+			return state.encryptUncached(epoch, hierarchy, pattern, cipherSuite, encryptedKey)
+		}
 
-			/*
-			 * Since we dropped the lock (as a reader) and re-acquired it as a
-			 * writer, another thread may have intervened and calculated the
-			 * value we need, so check again just in case.
-			 */
-			if !identical {
-				/*
-				 * This is the common case after acquiring the lock as a
-				 * writer. Adjust the precomputed value in the entry, and set a
-				 * flag so we remember to actually do the encryption and update
-				 * the entry's other fields.
-				 */
-				wkdibe.AdjustPreparedAttributeList(entry.precomputed, params, entry.attrs, attrs)
-				updateEntryAndEncrypt = true
+		/*
+		 * Since we dropped the lock (as a reader) and re-acquired it as a
+		 * writer, another thread may have intervened and calculated the
+		 * value we need, so check again just in case.
+		 */
+		if slot = entry.find(epoch.Epoch, pattern, cipherSuite); slot == nil {
+			if slot, err = state.populateEncryptionSlot(entry, cacheKey, hierarchy, uriPath, epoch, pattern, timestamp, nearby); err != nil {
+				entry.lock.Unlock()
+				return key, err
 			}
 		}
 
-		if updateEntryAndEncrypt {
-			/* Fill in the entry. */
-			entry.pattern = pattern
-			entry.attrs = attrs
+		/*
+		 * We've now ensured that a slot of the cache entry matches our
+		 * pattern, so save the key and its encryption so we can use it here.
+		 */
+		entry.touch(slot)
+		key, err = state.suiteKey(slot.material, hierarchy, pattern, cipherSuite)
+		marshalEncryptedKey(encryptedKey, slot.epoch, slot.encryptedKey)
 
-			/* Sample a new symmetric key and encrypt it with WKD-IBE. */
-			_, encryptable := cryptutils.GenerateKey(entry.key[:])
-			entry.encryptedKey = wkdibe.EncryptPrepared(encryptable, params, entry.precomputed)
-		}
+		entry.lock.Unlock()
+	}
+
+	return key, err
+}
 
+// populateEncryptionSlot samples a new symmetric key for the provided pattern
+// of the URI of an encryption cache entry, stored in the cache under
+// cacheKey, and encrypts it under the provided epoch of public parameters. It
+// stores them, along with the precomputation for the pattern, in the slot of
+// the entry chosen by slotFor, which it returns. If no slot of the entry has
+// a precomputation to adjust, it adjusts nearby, a copy of the precomputation
+// of a nearby URI, if it is not nil. The caller must hold the entry's lock as
+// a writer.
+func (state *ClientState) populateEncryptionSlot(entry *encryptionCacheEntry, cacheKey string, hierarchy []byte, uriPath URIPath, epoch *ParamEpoch, pattern Pattern, timestamp time.Time, nearby *precomputationCopy) (*encryptionSlot, error) {
+	params := epoch.Params
+	slot := entry.slotFor(pattern, state.encryptionSlots)
+
+	var attrs wkdibe.AttributeList
+	if slot.precomputes(epoch.Epoch) {
+		/*
+		 * We're replacing a slot with a cached precomputation. We can't use
+		 * that precomputation directly in our encryption, but we can adjust
+		 * it to compute our new precomputation faster.
+		 */
+		attrs, _ = pattern.ToAttrsWithReference(slot.pattern, slot.attrs)
+		start := time.Now()
+		wkdibe.AdjustPreparedAttributeList(slot.precomputed, params, slot.attrs, attrs)
+		state.observeOperation(OperationAdjust, start)
+	} else {
 		/*
-		 * We've now ensured that the cache entry matches our pattern, so save
-		 * the key and its encryption so we can use it here.
+		 * The slot is new, or was populated under older public parameters,
+		 * or restored from a snapshot, so there is no precomputation in it
+		 * that we can reuse. If another slot, or else a nearby URI, has a
+		 * cached precomputation, then we can adjust a copy of it to obtain
+		 * the precomputation we need. Otherwise, we need to encrypt from
+		 * scratch. Either way, store the intermediate value (the
+		 * precomputation) in the slot for later use.
 		 */
-		copy(key[:], entry.key[:])
-		copy(encrypted[:EncryptedKeySize], entry.encryptedKey.Marshal(true))
+		reference := nearby
+		if other := entry.reference(epoch.Epoch); other != nil {
+			precomputed := new(wkdibe.PreparedAttributeList)
+			*precomputed = *other.precomputed
+			reference = &precomputationCopy{
+				pattern:     other.pattern,
+				attrs:       other.attrs,
+				precomputed: precomputed,
+			}
+		}
 
-		entry.lock.Unlock()
+		if reference != nil && len(reference.pattern) == len(pattern) {
+			attrs, _ = pattern.ToAttrsWithReference(reference.pattern, reference.attrs)
+			start := time.Now()
+			wkdibe.AdjustPreparedAttributeList(reference.precomputed, params, reference.attrs, attrs)
+			state.observeOperation(OperationAdjust, start)
+			slot.precomputed = reference.precomputed
+		} else {
+			attrs = pattern.ToAttrs()
+			start := time.Now()
+			slot.precomputed = wkdibe.PrepareAttributeList(params, attrs)
+			state.observeOperation(OperationPrepare, start)
+		}
 	}
 
-	/* Encrypt the message with the symmetric key. */
-	if err = aesCTREncryptInMem(encrypted[EncryptedKeySize:], message, key[:]); err != nil {
+	/* Fill in the slot. */
+	entry.uriPath = append(URIPath(nil), uriPath...)
+	slot.epoch = epoch.Epoch
+	slot.timestamp = timestamp
+	slot.pattern = pattern
+	slot.restored = false
+	slot.attrs = attrs
+	if slot.material == nil {
+		slot.material = state.newKeyMaterial()
+	}
+
+	/*
+	 * Sample a new WKD-IBE plaintext, derive the symmetric key from it, and
+	 * encrypt it with WKD-IBE. Only the copy of the plaintext in the slot's
+	 * key material is kept.
+	 */
+	var secret [keyDerivationSecretSize]byte
+	_, encryptable := cryptutils.GenerateKey(secret[:])
+	slot.material.encryptable = *encryptable
+	zeroBytes(secret[:])
+	wipeEncryptable(encryptable)
+	if err := state.symmetricKey(slot.material.key[:], &slot.material.encryptable, hierarchy, pattern, cipherSuiteAES128CTR); err != nil {
+		/* Mark the slot as empty, so it is rebuilt from scratch. */
+		slot.pattern = nil
 		return nil, err
 	}
+	start := time.Now()
+	slot.encryptedKey = wkdibe.EncryptPrepared(&slot.material.encryptable, params, slot.precomputed)
+	state.observeOperation(OperationEncrypt, start)
 
-	return encrypted, nil
+	/* Let new URIs near this one reuse its precomputation. */
+	state.nearby.insert(hierarchy, entry.uriPath, entry)
+
+	if state.encryptionExpiry {
+		state.expiry.schedule(cacheKey, CacheKindEncryption, entry, state.encryptionDeadline(entry.latest()))
+	}
+	return slot, nil
+}
+
+// encryptUncached is like encryptionKey, but samples a new symmetric key and
+// encrypts it from scratch under the provided epoch of public parameters,
+// without using or populating the cache. It is used when the cache entry for
+// the URI was evicted while it was being used.
+func (state *ClientState) encryptUncached(epoch *ParamEpoch, hierarchy []byte, pattern Pattern, cipherSuite string, encryptedKey []byte) ([AESKeySize]byte, error) {
+	var key [AESKeySize]byte
+
+	var secret [keyDerivationSecretSize]byte
+	_, encryptable := cryptutils.GenerateKey(secret[:])
+	defer wipeEncryptable(encryptable)
+	zeroBytes(secret[:])
+
+	if err := state.symmetricKey(key[:], encryptable, hierarchy, pattern, cipherSuite); err != nil {
+		return key, err
+	}
+	start := time.Now()
+	ciphertext := wkdibe.Encrypt(encryptable, epoch.Params, pattern.ToAttrs())
+	state.observeOperation(OperationEncrypt, start)
+	marshalEncryptedKey(encryptedKey, epoch.Epoch, ciphertext)
+	return key, nil
 }
 
 // Decrypt decrypts a message encrypted with JEDI, reading from and mutating
@@ -199,11 +460,12 @@ func (state *ClientState) EncryptWithPattern(ctx context.Context, hierarchy []by
 // be cached in the ClientState, denying service for future proper messages
 // reusing that pattern.
 func (state *ClientState) Decrypt(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, encrypted []byte) ([]byte, error) {
-	if len(encrypted) < EncryptedKeySize+aes.BlockSize {
+	keySize := state.messageKeySize()
+	if len(encrypted) < keySize+aes.BlockSize {
 		return nil, errors.New("Encrypted blob is too short to be valid")
 	}
-	encryptedKey := encrypted[:EncryptedKeySize]
-	encryptedMessage := encrypted[EncryptedKeySize:]
+	encryptedKey := encrypted[:keySize]
+	encryptedMessage := encrypted[keySize:]
 	return state.DecryptSeparated(ctx, hierarchy, uri, timestamp, encryptedKey, encryptedMessage)
 }
 
@@ -211,23 +473,10 @@ func (state *ClientState) Decrypt(ctx context.Context, hierarchy []byte, uri str
 // in two parts: the WKD-IBE ciphertext of the encrypted symmetric key, and the
 // symmetric-key ciphertext of the encrypted message.
 func (state *ClientState) DecryptSeparated(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, encryptedKey []byte, encryptedMessage []byte) ([]byte, error) {
-	var err error
-
-	/* Parse the URI. */
-	var uriPath URIPath
-	if uriPath, err = ParseURI(uri); err != nil {
-		return nil, err
-	}
-
-	/* Parse the current time. */
-	var timePath TimePath
-	if timePath, err = ParseTime(timestamp); err != nil {
+	_, pattern, err := state.encodePattern(uri, timestamp)
+	if err != nil {
 		return nil, err
 	}
-
-	/* Encode the pattern based on the URI path and time path. */
-	pattern := state.encoder.Encode(uriPath, timePath, PatternTypeDecryption)
-
 	return state.DecryptWithPattern(ctx, hierarchy, pattern, encryptedKey, encryptedMessage)
 }
 
@@ -238,87 +487,281 @@ func (state *ClientState) DecryptWithPattern(ctx context.Context, hierarchy []by
 	var err error
 
 	/* Sanity-check the length of the encryptedMessage and encryptedKey. */
-	if len(encryptedKey) != EncryptedKeySize {
+	if len(encryptedKey) != state.messageKeySize() {
 		return nil, errors.New("encryptedKey has invalid size")
 	}
 	if len(encryptedMessage) < aes.BlockSize {
 		return nil, errors.New("encryptedMessage has invalid size")
 	}
+	if err = state.checkPattern(pattern); err != nil {
+		return nil, err
+	}
 
-	/* Check if we've cached the decryption of this ciphertext. */
-	var entryInt interface{}
-	if entryInt, err = state.cache.Get(ctx, decryptionCacheKey(encryptedKey)); err != nil {
+	var key [AESKeySize]byte
+	defer zeroBytes(key[:])
+	if key, err = state.decryptionKey(ctx, hierarchy, pattern, cipherSuiteAES128CTR, state.expandMessageKey(encryptedKey)); err != nil {
 		return nil, err
 	}
-	entry := entryInt.(*decryptionCacheEntry)
 
+	decrypted := make([]byte, len(encryptedMessage)-aes.BlockSize)
+	if err = aesCTRDecryptInMem(decrypted, encryptedMessage, key[:]); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// decryptionKey returns the symmetric key, for the provided cipher suite,
+// encrypted in encryptedKey, which contains a WKD-IBE ciphertext for the
+// provided pattern. The decryption is cached, so that it is reused for subsequent
+// messages with the same encryptedKey. The caller should wipe the returned
+// key once it is done with it.
+func (state *ClientState) decryptionKey(ctx context.Context, hierarchy []byte, pattern Pattern, cipherSuite string, encryptedKey []byte) ([AESKeySize]byte, error) {
+	/* Check if we've cached the decryption of this ciphertext. */
+	cacheKey := decryptionCacheKey(hierarchy, encryptedKey)
+	entry, ciphertext, err := state.lookupDecryption(ctx, cacheKey, hierarchy, pattern, encryptedKey)
+	if err != nil {
+		return [AESKeySize]byte{}, err
+	}
+
+	return state.decryptionForEntry(ctx, cacheKey, entry, hierarchy, pattern, cipherSuite, encryptedKey, ciphertext)
+}
+
+// lookupDecryption looks up the decryption cache entry, stored under
+// cacheKey, for encryptedKey. Before the lookup, it checks that encryptedKey
+// has the right size and was encrypted under an epoch of public parameters
+// that is still accepted, and that the pattern has the right length. If the
+// entry is not in the cache, the ciphertext is parsed and checked, and its
+// decryption admitted, before the entry is created (see
+// WithAdmissionControl); the parsed ciphertext is then returned along with
+// the entry, and is nil otherwise.
+func (state *ClientState) lookupDecryption(ctx context.Context, cacheKey string, hierarchy []byte, pattern Pattern, encryptedKey []byte) (*decryptionCacheEntry, *wkdibe.Ciphertext, error) {
+	if len(encryptedKey) != EncryptedKeySize {
+		return nil, nil, errors.New("encryptedKey has invalid size")
+	}
+	if err := state.checkPattern(pattern); err != nil {
+		return nil, nil, err
+	}
+	if _, err := state.acceptedParamEpoch(ctx, hierarchy, encryptedKey); err != nil {
+		return nil, nil, err
+	}
+
+	cold := &coldDecryption{
+		hierarchy:    hierarchy,
+		pattern:      pattern,
+		encryptedKey: encryptedKey,
+	}
+	entryInt, err := state.cacheGet(withColdDecryption(ctx, cold), cacheKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entryInt.(*decryptionCacheEntry), cold.ciphertext, nil
+}
+
+// decryptionForEntry returns the symmetric key, for the provided cipher
+// suite, cached in the provided decryption cache entry, decrypting
+// encryptedKey to populate the entry if necessary. The slow part of the
+// decryption (the key store lookup and the pairing) happens without holding
+// the entry's lock. Concurrent callers for the same entry wait for a single
+// in-flight decryption, but may stop waiting when their own context is
+// cancelled. If the decryption fails, the error is shared with the waiters,
+// and the entry, which is stored in the cache under cacheKey, is evicted, so
+// that ciphertexts that cannot be decrypted do not occupy the cache. If the
+// entry is evicted and wiped, the ciphertext is decrypted without the cache,
+// as it is if the entry was populated for a different ciphertext whose digest
+// collides with this one's. The entry should have been obtained with
+// lookupDecryption, which checks the epoch of public parameters recorded
+// in encryptedKey, along with ciphertext, which is the ciphertext that
+// lookupDecryption parsed from encryptedKey, or nil if it did not parse it.
+func (state *ClientState) decryptionForEntry(ctx context.Context, cacheKey string, entry *decryptionCacheEntry, hierarchy []byte, pattern Pattern, cipherSuite string, encryptedKey []byte, ciphertext *wkdibe.Ciphertext) ([AESKeySize]byte, error) {
 	var key [AESKeySize]byte
 
-	/*
-	 * Acquire the entry's lock as a reader, optimistically assuming it's
-	 * populated and we can skip the decryption.
-	 */
-	entry.lock.RLock()
-	if entry.populated {
+	for {
 		/*
-		 * We've seen this ciphertext before and decrypted it, so just copy
-		 * the result.
+		 * Acquire the entry's lock as a reader, optimistically assuming it's
+		 * populated and we can skip the decryption.
 		 */
-		copy(key[:], entry.decrypted[:])
+		entry.lock.RLock()
+		if entry.populated && bytes.Equal(entry.header, encryptedKey) {
+			key, err := state.suiteKey(entry.material, hierarchy, pattern, cipherSuite)
+			entry.lock.RUnlock()
+			return key, err
+		}
+		collided := entry.populated
+		wiped := entry.wiped
 		entry.lock.RUnlock()
-	} else {
+
+		if wiped || collided {
+			return state.decryptUncached(ctx, hierarchy, pattern, cipherSuite, encryptedKey, ciphertext)
+		}
+
 		/*
-		 * We need to decrypt the ciphertext and mutate this cache entry to
-		 * store the decrypted key.
+		 * We need to decrypt the ciphertext. Either join a decryption that
+		 * another goroutine has already started, or start one ourselves.
 		 */
-		entry.lock.RUnlock()
 		entry.lock.Lock()
+		if entry.populated && bytes.Equal(entry.header, encryptedKey) {
+			/*
+			 * Another goroutine finished the decryption after we dropped
+			 * the lock as a reader.
+			 */
+			key, err := state.suiteKey(entry.material, hierarchy, pattern, cipherSuite)
+			entry.lock.Unlock()
+			return key, err
+		}
+		if entry.wiped || entry.populated {
+			entry.lock.Unlock()
+			return state.decryptUncached(ctx, hierarchy, pattern, cipherSuite, encryptedKey, ciphertext)
+		}
+		call := entry.pending
+		leader := call == nil
+		if leader {
+			call = &decryptionCall{done: make(chan struct{})}
+			entry.pending = call
+		}
+		entry.lock.Unlock()
+
+		if leader {
+			material := state.newKeyMaterial()
+			call.err = state.decryptSymmetricKey(ctx, hierarchy, pattern, encryptedKey, ciphertext, material)
+			call.abandoned = call.err != nil && ctx.Err() != nil
 
-		/*
-		 * Since we dropped the lock (as a reader) and re-acquired it as a
-		 * writer, another thread may have intervened and performed the
-		 * decryption for us, so check again just in case.
-		 */
-		if entry.populated {
-			/* The decryption is available now, so just copy it. */
-			copy(key[:], entry.decrypted[:])
-		} else {
 			/*
-			 * This is the common case after acquiring the lock as a writer.
-			 * Actually perform the decryption, store the result in the entry,
-			 * and then release the lock.
+			 * Derive our key while holding the lock, since the entry may be
+			 * wiped as soon as we release it. If the entry was wiped while
+			 * we were decrypting, then don't populate it; just use the key
+			 * material ourselves, and wipe it when we're done.
 			 */
-			var ciphertext wkdibe.Ciphertext
-			if !ciphertext.Unmarshal(encryptedKey, true, false) {
-				entry.lock.Unlock()
-				return nil, errors.New("malformed ciphertext")
+			var err error
+			cached := false
+			entry.lock.Lock()
+			if call.err == nil {
+				key, err = state.suiteKey(material, hierarchy, pattern, cipherSuite)
+				if !entry.wiped {
+					entry.header = append([]byte(nil), encryptedKey...)
+					entry.material = material
+					entry.populated = true
+					cached = true
+				}
 			}
+			entry.pending = nil
+			entry.lock.Unlock()
 
-			var params *wkdibe.Params
-			var secretKey *wkdibe.SecretKey
-			if params, secretKey, err = state.store.KeyForPattern(ctx, hierarchy, pattern); err != nil {
-				entry.lock.Unlock()
-				return nil, err
+			if !cached {
+				state.releaseKeyMaterial(material)
+			} else if state.decryptionTTL != 0 {
+				state.expiry.schedule(cacheKey, CacheKindDecryption, entry, time.Now().Add(state.decryptionTTL))
 			}
-			if secretKey == nil {
-				entry.lock.Unlock()
-				return nil, errors.New("could not find suitable key for decryption: requisite delegation(s) not received")
+			if call.err != nil && !call.abandoned {
+				state.cache.Evict(state.loader, CacheKindDecryption, cacheKey)
 			}
 
-			secretKey = wkdibe.NonDelegableQualifyKey(params, secretKey, pattern.ToAttrs())
+			close(call.done)
+			if call.err != nil {
+				return key, call.err
+			}
+			return key, err
+		}
 
-			encryptable := wkdibe.Decrypt(&ciphertext, secretKey)
-			encryptable.HashToSymmetricKey(entry.decrypted[:])
-			copy(key[:], entry.decrypted[:])
-			entry.populated = true
+		atomic.AddInt32(&call.waiters, 1)
+		select {
+		case <-call.done:
+			atomic.AddInt32(&call.waiters, -1)
+		case <-ctx.Done():
+			atomic.AddInt32(&call.waiters, -1)
+			return key, ctx.Err()
 		}
 
-		entry.lock.Unlock()
+		/*
+		 * If the decryption failed, then return the error, unless it failed
+		 * only because the goroutine performing it had its context
+		 * cancelled, in which case try again with our own context. If it
+		 * succeeded, then the entry is now either populated or wiped, so
+		 * the next iteration returns.
+		 */
+		if call.err != nil && !call.abandoned {
+			return key, call.err
+		}
 	}
+}
 
-	decrypted := make([]byte, len(encryptedMessage)-aes.BlockSize)
-	if err = aesCTRDecryptInMem(decrypted, encryptedMessage, key[:]); err != nil {
-		return nil, err
+// decryptUncached is like decryptionKey, but neither uses nor populates the
+// cache entry for the ciphertext. It is used when the cache entry was evicted
+// while it was being used.
+func (state *ClientState) decryptUncached(ctx context.Context, hierarchy []byte, pattern Pattern, cipherSuite string, encryptedKey []byte, ciphertext *wkdibe.Ciphertext) ([AESKeySize]byte, error) {
+	material := state.newKeyMaterial()
+	defer state.releaseKeyMaterial(material)
+
+	if err := state.decryptSymmetricKey(ctx, hierarchy, pattern, encryptedKey, ciphertext, material); err != nil {
+		return [AESKeySize]byte{}, err
 	}
-	return decrypted, nil
+	return state.suiteKey(material, hierarchy, pattern, cipherSuite)
+}
+
+// unmarshalCiphertext parses, and unless ciphertexts are trusted, checks the
+// WKD-IBE ciphertext in encryptedKey.
+func (state *ClientState) unmarshalCiphertext(encryptedKey []byte) (*wkdibe.Ciphertext, error) {
+	ciphertext := new(wkdibe.Ciphertext)
+	if !ciphertext.Unmarshal(encryptedKey[ParamEpochLength:], true, !state.trustedCiphertexts) {
+		return nil, errors.New("malformed ciphertext")
+	}
+	return ciphertext, nil
+}
+
+// decryptSymmetricKey performs the WKD-IBE decryption of encryptedKey to
+// recover the WKD-IBE plaintext that it encrypts, and stores the plaintext,
+// and the AES-CTR key derived from it, in material. If ciphertext is not
+// nil, it is the ciphertext already parsed from encryptedKey.
+func (state *ClientState) decryptSymmetricKey(ctx context.Context, hierarchy []byte, pattern Pattern, encryptedKey []byte, ciphertext *wkdibe.Ciphertext, material *keyMaterial) error {
+	epoch := encryptedKeyEpoch(encryptedKey)
+	if ciphertext == nil {
+		var err error
+		if ciphertext, err = state.unmarshalCiphertext(encryptedKey); err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * Messages for the same URI and time share a pattern, so look up the
+	 * qualified key in the cache to avoid repeating the key store lookup and
+	 * the qualification for each new ciphertext.
+	 */
+	cacheKey := qualifiedKeyCacheKey(hierarchy, epoch, pattern)
+	keyInt, err := state.cacheGet(ctx, cacheKey)
+	if err != nil {
+		return err
+	}
+	entry := keyInt.(*qualifiedKeyCacheEntry)
+
+	/*
+	 * Hold the entry's lock as a reader while using the key, so that it
+	 * isn't wiped in the middle of the decryption.
+	 */
+	var encryptable *cryptutils.Encryptable
+	entry.lock.RLock()
+	if entry.key != nil {
+		start := time.Now()
+		encryptable = wkdibe.Decrypt(ciphertext, entry.key)
+		state.observeOperation(OperationDecrypt, start)
+	}
+	entry.lock.RUnlock()
+
+	if encryptable == nil {
+		/*
+		 * The entry was evicted, and its key wiped, after we looked it up,
+		 * so qualify a key just for this decryption.
+		 */
+		var value interface{}
+		if value, err = state.load(ctx, cacheKey); err != nil {
+			return err
+		}
+		private := value.(*qualifiedKeyCacheEntry)
+		start := time.Now()
+		encryptable = wkdibe.Decrypt(ciphertext, private.key)
+		state.observeOperation(OperationDecrypt, start)
+		state.wipeCacheEntry(private)
+	}
+
+	material.encryptable = *encryptable
+	wipeEncryptable(encryptable)
+	return state.symmetricKey(material.key[:], &material.encryptable, hierarchy, pattern, cipherSuiteAES128CTR)
 }
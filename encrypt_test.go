@@ -36,6 +36,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -75,6 +80,32 @@ func (tks *TestKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pa
 	return tks.params, wkdibe.KeyGen(tks.params, tks.master, empty.ToAttrs()), nil
 }
 
+type countingKeyStore struct {
+	KeyStoreReader
+	lookups int32
+}
+
+func (cks *countingKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	atomic.AddInt32(&cks.lookups, 1)
+	return cks.KeyStoreReader.KeyForPattern(ctx, hierarchy, pattern)
+}
+
+type blockingKeyStore struct {
+	KeyStoreReader
+	entered chan struct{}
+	release chan struct{}
+	fail    int32
+}
+
+func (bks *blockingKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	bks.entered <- struct{}{}
+	<-bks.release
+	if atomic.CompareAndSwapInt32(&bks.fail, 1, 0) {
+		return nil, nil, errors.New("key store unavailable")
+	}
+	return bks.KeyStoreReader.KeyForPattern(ctx, hierarchy, pattern)
+}
+
 func NewTestState() *ClientState {
 	info, store := NewTestKeyStore()
 	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
@@ -82,22 +113,31 @@ func NewTestState() *ClientState {
 }
 
 func testMessageTransfer(t *testing.T, state *ClientState, hierarchy []byte, uri string, timestamp time.Time, message string) {
+	if err := transferMessage(state, hierarchy, uri, timestamp, message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transferMessage is like testMessageTransfer, but returns an error instead
+// of failing the test, so that it can be called from other goroutines.
+func transferMessage(state *ClientState, hierarchy []byte, uri string, timestamp time.Time, message string) error {
 	var err error
 	ctx := context.Background()
 
 	var encrypted []byte
 	if encrypted, err = state.Encrypt(ctx, hierarchy, uri, timestamp, []byte(message)); err != nil {
-		t.Fatal(err)
+		return err
 	}
 
 	var decrypted []byte
 	if decrypted, err = state.Decrypt(ctx, hierarchy, uri, timestamp, encrypted); err != nil {
-		t.Fatal(err)
+		return err
 	}
 
 	if !bytes.Equal(decrypted, []byte(message)) {
-		t.Fatal("Original and decrypted messages differ")
+		return errors.New("Original and decrypted messages differ")
 	}
+	return nil
 }
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -107,6 +147,15 @@ func TestEncryptDecrypt(t *testing.T) {
 	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
 }
 
+func TestEncryptDecryptTrustedCiphertexts(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(info, store, encoder, 1<<20, WithTrustedCiphertexts())
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+}
+
 func TestCachedEncryptDecrypt(t *testing.T) {
 	state := NewTestState()
 	now := time.Now()
@@ -124,6 +173,311 @@ func TestEncryptAdjustment(t *testing.T) {
 	testMessageTransfer(t, state, TestHierarchy, "a/b/c", future, quote1)
 }
 
+// encryptHeaders encrypts a message for a URI at each of the provided times
+// in turn, checks that each decrypts, and returns the header of each.
+func encryptHeaders(t *testing.T, state *ClientState, uri string, times []time.Time) [][]byte {
+	ctx := context.Background()
+	headers := make([][]byte, len(times))
+	for i, timestamp := range times {
+		encrypted, err := state.Encrypt(ctx, TestHierarchy, uri, timestamp, []byte(quote1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := state.Decrypt(ctx, TestHierarchy, uri, timestamp, encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != quote1 {
+			t.Fatal("Original and decrypted messages differ")
+		}
+		headers[i] = encrypted[:EncryptedKeySize]
+	}
+	return headers
+}
+
+func TestEncryptionSlots(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics), WithEncryptionSlots(2))
+	now := time.Now()
+	backfill := now.Add(-2 * time.Hour)
+	older := now.Add(-4 * time.Hour)
+
+	/* Interleaving live and backfilled data encrypts once for each hour. */
+	headers := encryptHeaders(t, state, "a/b/c", []time.Time{now, backfill, now, backfill})
+	if !bytes.Equal(headers[0], headers[2]) || !bytes.Equal(headers[1], headers[3]) {
+		t.Fatal("Interleaved hours did not reuse their headers")
+	}
+	if count := metrics.OperationStats(OperationEncrypt).Count; count != 2 {
+		t.Fatalf("Expected 2 encryptions, got %d", count)
+	}
+	if count := metrics.OperationStats(OperationPrepare).Count; count != 1 {
+		t.Fatalf("Expected the second slot to adjust the first's precomputation, got %d preparations", count)
+	}
+
+	/* A third hour replaces the least recently used slot. */
+	headers = append(headers, encryptHeaders(t, state, "a/b/c", []time.Time{now, older, now, backfill})...)
+	if !bytes.Equal(headers[0], headers[4]) || !bytes.Equal(headers[0], headers[6]) {
+		t.Fatal("Most recently used slot was replaced")
+	}
+	if bytes.Equal(headers[1], headers[7]) {
+		t.Fatal("Least recently used slot was not replaced")
+	}
+	if count := metrics.OperationStats(OperationEncrypt).Count; count != 4 {
+		t.Fatalf("Expected 4 encryptions, got %d", count)
+	}
+
+	uriPath, err := ParseURI("a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := liveEntries(state)[encryptionCacheKey(TestHierarchy, uriPath)].(*encryptionCacheEntry)
+	if len(entry.slots) != 2 {
+		t.Fatalf("Entry has %d slots, but is limited to 2", len(entry.slots))
+	}
+}
+
+func TestEncryptionSingleSlot(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics))
+	now := time.Now()
+	backfill := now.Add(-2 * time.Hour)
+
+	encryptHeaders(t, state, "a/b/c", []time.Time{now, backfill, now, backfill})
+	if count := metrics.OperationStats(OperationEncrypt).Count; count != 4 {
+		t.Fatalf("Expected 4 encryptions with one slot, got %d", count)
+	}
+}
+
+func TestEncryptNearbyURI(t *testing.T) {
+	state := NewTestState()
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c/d1", now, quote1)
+
+	uriPath, err := ParseURI("a/b/c/d2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.nearby.nearest(TestHierarchy, uriPath) == nil {
+		t.Fatal("No nearby cache entry for sibling URI")
+	}
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c/d2", now, quote2)
+	testMessageTransfer(t, state, TestHierarchy, "a/e", now.Add(time.Hour), quote1)
+}
+
+func TestEncryptNearbyURIConcurrent(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	ctx := context.Background()
+	now := time.Now()
+
+	/*
+	 * Siblings encrypting at once copy each other's precomputations. The
+	 * cache is small, so that entries are evicted and rebuilt from their
+	 * neighbours while the neighbours are being populated.
+	 */
+	state := NewClientState(info, store, encoder, 1<<14, WithEncryptionSlots(2))
+
+	const workers = 8
+	errs := make(chan error, workers)
+	for i := 0; i != workers; i++ {
+		go func(i int) {
+			for j := 0; j != 50; j++ {
+				uri := fmt.Sprintf("a/b/%d", (i+j)%4)
+				timestamp := now.Add(time.Duration(j%3) * time.Hour)
+				if _, err := state.Encrypt(ctx, TestHierarchy, uri, timestamp, []byte(quote1)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+
+	timeout := time.After(time.Minute)
+	for i := 0; i != workers; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("Concurrent encryptions of nearby URIs deadlocked")
+		}
+	}
+}
+
+func TestDecryptQualifiedKeyCached(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	now := time.Now()
+	ctx := context.Background()
+
+	/* Two publishers produce different ciphertexts for the same pattern. */
+	publisher1 := NewClientState(info, store, encoder, 1<<20)
+	publisher2 := NewClientState(info, store, encoder, 1<<20)
+
+	var encrypted1, encrypted2 []byte
+	if encrypted1, err = publisher1.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted2, err = publisher2.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote2)); err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &countingKeyStore{KeyStoreReader: store}
+	subscriber := NewClientState(info, counting, encoder, 1<<20)
+	for i, encrypted := range [][]byte{encrypted1, encrypted2} {
+		var decrypted []byte
+		if decrypted, err = subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte([]string{quote1, quote2}[i])) {
+			t.Fatal("Original and decrypted messages differ")
+		}
+	}
+
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 1 {
+		t.Fatalf("Expected 1 key store lookup, got %d", lookups)
+	}
+}
+
+// waitForDecryptionWaiters waits until n goroutines are waiting for an
+// in-flight decryption in one of the state's decryption cache entries.
+func waitForDecryptionWaiters(t *testing.T, state *ClientState, n int32) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		for _, value := range liveEntries(state) {
+			entry, ok := value.(*decryptionCacheEntry)
+			if !ok {
+				continue
+			}
+			entry.lock.RLock()
+			call := entry.pending
+			entry.lock.RUnlock()
+			if call != nil && atomic.LoadInt32(&call.waiters) == n {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d decryption waiters", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDecryptWaitersNotBlocked(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	now := time.Now()
+	ctx := context.Background()
+
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	var encrypted []byte
+	if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingKeyStore{
+		KeyStoreReader: store,
+		entered:        make(chan struct{}),
+		release:        make(chan struct{}),
+		fail:           1,
+	}
+	subscriber := NewClientState(info, blocking, encoder, 1<<20)
+
+	/* The first decryption blocks in the key store, and then fails. */
+	leaderErr := make(chan error)
+	go func() {
+		_, err := subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted)
+		leaderErr <- err
+	}()
+	<-blocking.entered
+
+	/* A waiter whose context is cancelled gives up without blocking. */
+	cancelled, cancel := context.WithCancel(ctx)
+	waiterErr := make(chan error)
+	go func() {
+		_, err := subscriber.Decrypt(cancelled, TestHierarchy, "a/b/c", now, encrypted)
+		waiterErr <- err
+	}()
+	waitForDecryptionWaiters(t, subscriber, 1)
+	cancel()
+	if err = <-waiterErr; err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	close(blocking.release)
+	if err = <-leaderErr; err == nil {
+		t.Fatal("Expected the first decryption to fail")
+	}
+
+	/* The failure is not cached, so the next decryption succeeds. */
+	go func() {
+		for range blocking.entered {
+		}
+	}()
+	defer close(blocking.entered)
+
+	var decrypted []byte
+	if decrypted, err = subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
+
+func TestDecryptLeaderErrorShared(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	now := time.Now()
+	ctx := context.Background()
+
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	var encrypted []byte
+	if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	blocking := &blockingKeyStore{
+		KeyStoreReader: store,
+		entered:        make(chan struct{}),
+		release:        make(chan struct{}),
+		fail:           1,
+	}
+	subscriber := NewClientState(info, blocking, encoder, 1<<20)
+
+	const waiters = 4
+	errs := make(chan error, waiters+1)
+	decrypt := func() {
+		_, err := subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted)
+		errs <- err
+	}
+	go decrypt()
+	<-blocking.entered
+	for i := 0; i != waiters; i++ {
+		go decrypt()
+	}
+	waitForDecryptionWaiters(t, subscriber, waiters)
+	close(blocking.release)
+
+	/* Every waiter sees the leader's error, without its own lookup. */
+	for i := 0; i != waiters+1; i++ {
+		if err = <-errs; err == nil || err.Error() != "key store unavailable" {
+			t.Fatalf("Expected the key store's error, got %v", err)
+		}
+	}
+}
+
 func TestDecryptWrongURI(t *testing.T) {
 	var err error
 	state := NewTestState()
@@ -162,11 +516,84 @@ func TestDecryptWrongLength(t *testing.T) {
 		t.Fatal("No error for trying to decrypt too short a message (encrypted key size short, encrypted message OK)")
 	}
 
-	if _, err = state.DecryptWithPattern(ctx, TestHierarchy, make(Pattern, TestPatternSize), make([]byte, EncryptedKeySize), make([]byte, aes.BlockSize)); err != nil {
+	/* Use a valid WKD-IBE ciphertext, since invalid ones are rejected. */
+	var encrypted []byte
+	if encrypted, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = state.DecryptWithPattern(ctx, TestHierarchy, make(Pattern, TestPatternSize), encrypted[:EncryptedKeySize], make([]byte, aes.BlockSize)); err != nil {
 		t.Fatal("Got error for correctly-size message")
 	}
 }
 
+func TestDecryptInvalidHeader(t *testing.T) {
+	var err error
+	state := NewTestState()
+	now := time.Now()
+	ctx := context.Background()
+
+	var encrypted []byte
+	if encrypted, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+	 * Corrupt a coordinate of the first group element in the header, after
+	 * the epoch.
+	 */
+	corrupted := append([]byte(nil), encrypted...)
+	corrupted[ParamEpochLength+1] ^= 0x01
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, corrupted); err == nil {
+		t.Fatal("No error for decrypting a header with an invalid group element")
+	}
+
+	/* A header that does not encode points at all must also be rejected. */
+	invalid := append([]byte(nil), encrypted...)
+	for i := ParamEpochLength; i != EncryptedKeySize; i++ {
+		invalid[i] = 0xFF
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, invalid); err == nil {
+		t.Fatal("No error for decrypting a header with malformed group elements")
+	}
+
+	/* The valid ciphertext still decrypts. */
+	var decrypted []byte
+	if decrypted, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != quote1 {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
+
+// indexingPatternEncoder is a PatternEncoder, not reporting its pattern
+// length, that indexes into the URI and time that it encodes.
+type indexingPatternEncoder struct {
+	encoder *DefaultPatternEncoder
+}
+
+func (ipe *indexingPatternEncoder) Encode(uriPath URIPath, timePath TimePath, patternType PatternType) Pattern {
+	if uriPath[0] == nil || timePath[0] == nil {
+		panic("Encoding an empty URI or time")
+	}
+	return ipe.encoder.Encode(uriPath, timePath, patternType)
+}
+
+func TestCustomPatternEncoder(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := &indexingPatternEncoder{encoder: NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)}
+	state := NewClientState(info, store, encoder, 1<<20)
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+	if state.checkPattern(make(Pattern, TestPatternSize)) != nil {
+		t.Fatal("Pattern of the encoder's length was rejected")
+	}
+	if state.checkPattern(make(Pattern, TestPatternSize+1)) == nil {
+		t.Fatal("Pattern of the wrong length was accepted")
+	}
+}
+
 func TestInvalidURI(t *testing.T) {
 	var err error
 	state := NewTestState()
@@ -181,3 +608,221 @@ func TestInvalidURI(t *testing.T) {
 		t.Fatal("No error for trying to decrypt with an invalid URI")
 	}
 }
+
+// versionedTestKeyStore has one TestKeyStore for each epoch of public
+// parameters, and reports them through the versioned interfaces.
+type versionedTestKeyStore struct {
+	lock    sync.Mutex
+	epochs  []ParamEpoch
+	stores  map[uint32]*TestKeyStore
+	lookups int32
+}
+
+func newVersionedTestKeyStore() *versionedTestKeyStore {
+	return &versionedTestKeyStore{stores: make(map[uint32]*TestKeyStore)}
+}
+
+func (vks *versionedTestKeyStore) addEpoch(epoch uint32) {
+	_, store := NewTestKeyStore()
+	vks.lock.Lock()
+	defer vks.lock.Unlock()
+	vks.stores[epoch] = store
+	vks.epochs = append(vks.epochs, ParamEpoch{Epoch: epoch, Params: store.params})
+}
+
+func (vks *versionedTestKeyStore) retire(epoch uint32, retired time.Time) {
+	vks.lock.Lock()
+	defer vks.lock.Unlock()
+	for i := range vks.epochs {
+		if vks.epochs[i].Epoch == epoch {
+			vks.epochs[i].Retired = retired
+		}
+	}
+}
+
+func (vks *versionedTestKeyStore) ParamsForHierarchy(ctx context.Context, hierarchy []byte) (*wkdibe.Params, error) {
+	return nil, errors.New("ParamsForHierarchy called on a versioned PublicInfoReader")
+}
+
+func (vks *versionedTestKeyStore) ParamEpochsForHierarchy(ctx context.Context, hierarchy []byte) ([]ParamEpoch, error) {
+	atomic.AddInt32(&vks.lookups, 1)
+	vks.lock.Lock()
+	defer vks.lock.Unlock()
+	return append([]ParamEpoch(nil), vks.epochs...), nil
+}
+
+func (vks *versionedTestKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	return nil, nil, errors.New("KeyForPattern called on a versioned KeyStoreReader")
+}
+
+func (vks *versionedTestKeyStore) KeyForPatternInEpoch(ctx context.Context, hierarchy []byte, epoch uint32, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	vks.lock.Lock()
+	store := vks.stores[epoch]
+	vks.lock.Unlock()
+	if store == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+	return store.KeyForPattern(ctx, hierarchy, pattern)
+}
+
+func TestParamEpochRotation(t *testing.T) {
+	var err error
+	versioned := newVersionedTestKeyStore()
+	versioned.addEpoch(0)
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(versioned, versioned, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	var old []byte
+	if old, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, old); err != nil {
+		t.Fatal(err)
+	}
+
+	/* New messages are encrypted under the new epoch once it is added. */
+	versioned.addEpoch(1)
+	state.InvalidateHierarchy(TestHierarchy)
+
+	var rotated []byte
+	if rotated, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote2)); err != nil {
+		t.Fatal(err)
+	}
+	if epoch := encryptedKeyEpoch(rotated); epoch != 1 {
+		t.Fatalf("Message was encrypted under epoch %d", epoch)
+	}
+
+	/* Messages under both epochs are decrypted during the overlap. */
+	for i, encrypted := range [][]byte{old, rotated} {
+		var decrypted []byte
+		if decrypted, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte([]string{quote1, quote2}[i])) {
+			t.Fatal("Original and decrypted messages differ")
+		}
+	}
+
+	/* Once the old epoch is retired, its messages are rejected. */
+	versioned.retire(0, now.Add(-time.Second))
+	state.InvalidateHierarchy(TestHierarchy)
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, old); err != ErrParamEpochNotAccepted {
+		t.Fatalf("Decrypting under a retired epoch returned %v", err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, rotated); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParamEpochUnknown(t *testing.T) {
+	var err error
+	state := NewTestState()
+	now := time.Now()
+	ctx := context.Background()
+
+	var encrypted []byte
+	if encrypted, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	if epoch := encryptedKeyEpoch(encrypted); epoch != 0 {
+		t.Fatalf("Message was encrypted under epoch %d", epoch)
+	}
+
+	encrypted[0] = 7
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != ErrParamEpochNotAccepted {
+		t.Fatalf("Decrypting under an unknown epoch returned %v", err)
+	}
+}
+
+func TestInvalidateHierarchy(t *testing.T) {
+	versioned := newVersionedTestKeyStore()
+	versioned.addEpoch(0)
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(versioned, versioned, encoder, 1<<20)
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+	testMessageTransfer(t, state, []byte("otherHierarchy"), "a/b/c", now, quote1)
+	state.InvalidateHierarchy(TestHierarchy)
+
+	for key := range liveEntries(state) {
+		keytype, ns := parsekey(key)
+		if keytype != cacheKeyTypeDecryption && bytes.Equal(ns, TestHierarchy) {
+			t.Fatalf("%v entry for the hierarchy survived invalidation", cacheKindOf(key))
+		}
+	}
+	if _, ok := liveEntries(state)[hierarchyCacheKey([]byte("otherHierarchy"))]; !ok {
+		t.Fatal("Invalidating a hierarchy evicted the parameters of another")
+	}
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote2)
+	if lookups := atomic.LoadInt32(&versioned.lookups); lookups != 3 {
+		t.Fatalf("Expected 3 lookups of public parameters, got %d", lookups)
+	}
+}
+
+func TestDecryptionCacheKeyDigest(t *testing.T) {
+	header := make([]byte, EncryptedKeySize)
+	key := decryptionCacheKey(TestHierarchy, header)
+	if len(key) != 1+4+len(TestHierarchy)+sha256.Size {
+		t.Fatalf("Decryption cache key has length %d", len(key))
+	}
+	if keytype, ns := parsekey(key); keytype != cacheKeyTypeDecryption || !bytes.Equal(ns, TestHierarchy) {
+		t.Fatal("Decryption cache key does not parse to its hierarchy")
+	}
+
+	pattern := make(Pattern, TestPatternSize)
+	if patternKey := patternDecryptionCacheKey(TestHierarchy, pattern, header); patternKey == key || len(patternKey) != len(key) {
+		t.Fatal("Pattern decryption cache key is not a distinct digest")
+	}
+
+	header[len(header)-1] ^= 1
+	if decryptionCacheKey(TestHierarchy, header) == key {
+		t.Fatal("Decryption cache key does not depend on the ciphertext")
+	}
+}
+
+func TestDecryptionCacheDigestCollision(t *testing.T) {
+	state := NewTestState()
+	ctx := context.Background()
+	now := time.Now()
+
+	var err error
+	var encryptedA, encryptedB []byte
+	if encryptedA, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	if encryptedB, err = state.Encrypt(ctx, TestHierarchy, "a/b/d", now, []byte(quote2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encryptedA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/d", now, encryptedB); err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+	 * Make the entry for A look as if it had been populated by B, as it
+	 * would be if B's digest collided with A's.
+	 */
+	live := liveEntries(state)
+	entryA := live[decryptionCacheKey(TestHierarchy, encryptedA[:EncryptedKeySize])].(*decryptionCacheEntry)
+	entryB := live[decryptionCacheKey(TestHierarchy, encryptedB[:EncryptedKeySize])].(*decryptionCacheEntry)
+	entryA.lock.Lock()
+	entryB.lock.Lock()
+	entryA.header, entryB.header = entryB.header, entryA.header
+	entryA.material, entryB.material = entryB.material, entryA.material
+	entryB.lock.Unlock()
+	entryA.lock.Unlock()
+
+	decrypted, err := state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encryptedA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != quote1 {
+		t.Fatal("Decryption used the cached key of a colliding ciphertext")
+	}
+}
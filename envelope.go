@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"time"
+)
+
+// envelopeSignatureLabel is prepended to the data signed in an Envelope, so
+// that the signature cannot be confused with an Ed25519 signature produced
+// for another purpose.
+const envelopeSignatureLabel = "JEDI envelope v1"
+
+// Envelope is a JEDI ciphertext signed by its publisher with an Ed25519 key.
+// It provides a conventional, non-anonymous publisher identity on top of the
+// confidentiality provided by JEDI. The signature covers the hierarchy, the
+// pattern, and the entire ciphertext (the WKD-IBE ciphertext of the symmetric
+// key and the encrypted message).
+type Envelope struct {
+	Hierarchy  []byte
+	Pattern    Pattern
+	Ciphertext []byte
+	Signer     ed25519.PublicKey
+	Signature  []byte
+}
+
+// SignerTrustReader represents a read-only interface to the application's
+// policy on which publishers may publish on a URI. Like KeyStoreReader, it is
+// meant to be implemented by the calling application.
+type SignerTrustReader interface {
+	// TrustsSigner returns a boolean indicating whether messages signed
+	// with the provided public key should be accepted for the provided
+	// hierarchy and pattern.
+	TrustsSigner(ctx context.Context, hierarchy []byte, pattern Pattern, signer ed25519.PublicKey) (bool, error)
+}
+
+// signedData returns the data covered by the envelope's signature.
+func (e *Envelope) signedData() []byte {
+	buf := []byte(envelopeSignatureLabel)
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Hierarchy), buf)
+	buf = marshalAppendWithLength(&e.Pattern, buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Ciphertext), buf)
+	return buf
+}
+
+// SealEnvelope encrypts a message using JEDI, as in Encrypt, and signs the
+// result with the publisher's Ed25519 private key.
+func (state *ClientState) SealEnvelope(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, message []byte, signer ed25519.PrivateKey) (*Envelope, error) {
+	uriPath, pattern, err := state.encodePattern(uri, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	var ciphertext []byte
+	if ciphertext, err = state.encryptWithPattern(ctx, hierarchy, uriPath, pattern, timestamp, message); err != nil {
+		return nil, err
+	}
+
+	envelope := &Envelope{
+		Hierarchy:  hierarchy,
+		Pattern:    pattern,
+		Ciphertext: ciphertext,
+		Signer:     signer.Public().(ed25519.PublicKey),
+	}
+	envelope.Signature = ed25519.Sign(signer, envelope.signedData())
+	return envelope, nil
+}
+
+// OpenEnvelope verifies an envelope's signature and decrypts the message in
+// it. The signer must be trusted for the envelope's hierarchy and pattern,
+// according to the provided SignerTrustReader. The signature is checked before
+// the ciphertext is decrypted, so messages injected by a party without a
+// trusted signing key never reach the decryption cache (see the comment on
+// Decrypt).
+func (state *ClientState) OpenEnvelope(ctx context.Context, envelope *Envelope, trust SignerTrustReader) ([]byte, error) {
+	if len(envelope.Signer) != ed25519.PublicKeySize {
+		return nil, errors.New("envelope signer has invalid size")
+	}
+	keySize := state.messageKeySize()
+	if len(envelope.Ciphertext) < keySize {
+		return nil, errors.New("envelope ciphertext is too short to be valid")
+	}
+	if err := state.checkPattern(envelope.Pattern); err != nil {
+		return nil, err
+	}
+
+	trusted, err := trust.TrustsSigner(ctx, envelope.Hierarchy, envelope.Pattern, envelope.Signer)
+	if err != nil {
+		return nil, err
+	}
+	if !trusted {
+		return nil, errors.New("envelope signer is not trusted")
+	}
+	if !ed25519.Verify(envelope.Signer, envelope.signedData(), envelope.Signature) {
+		return nil, errors.New("envelope signature is invalid")
+	}
+
+	encryptedKey := envelope.Ciphertext[:keySize]
+	encryptedMessage := envelope.Ciphertext[keySize:]
+	return state.DecryptWithPattern(ctx, envelope.Hierarchy, envelope.Pattern, encryptedKey, encryptedMessage)
+}
+
+// Marshal encodes an Envelope into a byte slice.
+func (e *Envelope) Marshal() []byte {
+	buf := newMessageBuffer(1024+len(e.Ciphertext), MarshalledTypeEnvelope)
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Hierarchy), buf)
+	buf = marshalAppendWithLength(&e.Pattern, buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Ciphertext), buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Signer), buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Signature), buf)
+	return buf
+}
+
+// Unmarshal decodes an Envelope from a byte slice encoded with Marshal(). It
+// does not verify the signature; that happens in OpenEnvelope.
+func (e *Envelope) Unmarshal(marshalled []byte) bool {
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeEnvelope); buf == nil {
+		return false
+	}
+
+	var hierarchy marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&hierarchy, buf); buf == nil {
+		return false
+	}
+	e.Hierarchy = hierarchy.b
+
+	if buf, _ = unmarshalPrefixWithLength(&e.Pattern, buf); buf == nil {
+		return false
+	}
+
+	var ciphertext marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&ciphertext, buf); buf == nil {
+		return false
+	}
+	e.Ciphertext = ciphertext.b
+
+	var signer marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&signer, buf); buf == nil {
+		return false
+	}
+	if len(signer.b) != ed25519.PublicKeySize {
+		return false
+	}
+	e.Signer = ed25519.PublicKey(signer.b)
+
+	var signature marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&signature, buf); buf == nil {
+		return false
+	}
+	if len(signature.b) != ed25519.SignatureSize {
+		return false
+	}
+	e.Signature = signature.b
+
+	return len(buf) == 0
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSignerTrust struct {
+	trusted ed25519.PublicKey
+}
+
+func (tst *testSignerTrust) TrustsSigner(ctx context.Context, hierarchy []byte, pattern Pattern, signer ed25519.PublicKey) (bool, error) {
+	return tst.trusted.Equal(signer), nil
+}
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	subscriber := NewClientState(info, store, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	var public ed25519.PublicKey
+	var private ed25519.PrivateKey
+	if public, private, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope *Envelope
+	if envelope, err = publisher.SealEnvelope(ctx, TestHierarchy, "a/b/c", now, []byte(quote1), private); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Marshal and unmarshal the envelope, to check that as well. */
+	marshalled := envelope.Marshal()
+	envelope = new(Envelope)
+	if !envelope.Unmarshal(marshalled) {
+		t.Fatal("Could not unmarshal envelope")
+	}
+	if new(Envelope).Unmarshal(marshalled[:len(marshalled)-1]) {
+		t.Fatal("Unmarshalled a truncated envelope")
+	}
+	if new(Envelope).Unmarshal(append(marshalled, 0)) {
+		t.Fatal("Unmarshalled an envelope with trailing bytes")
+	}
+
+	var decrypted []byte
+	if decrypted, err = subscriber.OpenEnvelope(ctx, envelope, &testSignerTrust{trusted: public}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
+
+func TestEnvelopeRejected(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	counting := &countingKeyStore{KeyStoreReader: store}
+	subscriber := NewClientState(info, counting, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	var public ed25519.PublicKey
+	var private ed25519.PrivateKey
+	if public, private, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	trust := &testSignerTrust{trusted: public}
+
+	var otherPrivate ed25519.PrivateKey
+	if _, otherPrivate, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope *Envelope
+	if envelope, err = publisher.SealEnvelope(ctx, TestHierarchy, "a/b/c", now, []byte(quote1), otherPrivate); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = subscriber.OpenEnvelope(ctx, envelope, trust); err == nil {
+		t.Fatal("Opened an envelope from an untrusted signer")
+	}
+
+	if envelope, err = publisher.SealEnvelope(ctx, TestHierarchy, "a/b/c", now, []byte(quote1), private); err != nil {
+		t.Fatal(err)
+	}
+	envelope.Ciphertext[len(envelope.Ciphertext)-1] ^= 0x1
+	if _, err = subscriber.OpenEnvelope(ctx, envelope, trust); err == nil {
+		t.Fatal("Opened an envelope with a tampered ciphertext")
+	}
+
+	/* A signed envelope whose pattern has the wrong length is rejected. */
+	if envelope, err = publisher.SealEnvelope(ctx, TestHierarchy, "a/b/c", now, []byte(quote1), private); err != nil {
+		t.Fatal(err)
+	}
+	envelope.Pattern = append(envelope.Pattern, []byte("extra"))
+	envelope.Signature = ed25519.Sign(private, envelope.signedData())
+	if _, err = subscriber.OpenEnvelope(ctx, envelope, trust); err == nil {
+		t.Fatal("Opened an envelope with a pattern of the wrong length")
+	}
+
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 0 {
+		t.Fatal("Rejected envelopes reached decryption")
+	}
+}
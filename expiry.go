@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expiryRecord records when an object in the cache expires.
+type expiryRecord struct {
+	key      string
+	kind     CacheKind
+	value    interface{}
+	deadline time.Time
+	index    int
+}
+
+// expiryHeap is a min-heap of expiryRecords, ordered by deadline.
+type expiryHeap []*expiryRecord
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	record := x.(*expiryRecord)
+	record.index = len(*h)
+	*h = append(*h, record)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	record := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	record.index = -1
+	return record
+}
+
+// expiryQueue tracks the deadlines of objects in the cache that expire. There
+// is at most one record for each key; a record for an object that is no
+// longer in the cache is cancelled when the object is evicted.
+type expiryQueue struct {
+	lock    sync.Mutex
+	records map[string]*expiryRecord
+	heap    expiryHeap
+
+	/*
+	 * The earliest deadline in the queue, in nanoseconds since the Unix
+	 * epoch, or zero if the queue is empty. It's read without the lock, so
+	 * that lookups can check cheaply whether anything has expired.
+	 */
+	next int64
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{
+		records: make(map[string]*expiryRecord),
+	}
+}
+
+// updateNext must be called with the lock held, after the heap is modified.
+func (queue *expiryQueue) updateNext() {
+	var next int64
+	if len(queue.heap) != 0 {
+		next = queue.heap[0].deadline.UnixNano()
+	}
+	atomic.StoreInt64(&queue.next, next)
+}
+
+// schedule sets the deadline for the object stored under the provided key,
+// replacing any earlier deadline for that key.
+func (queue *expiryQueue) schedule(key string, kind CacheKind, value interface{}, deadline time.Time) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if record, ok := queue.records[key]; ok {
+		record.kind = kind
+		record.value = value
+		record.deadline = deadline
+		heap.Fix(&queue.heap, record.index)
+	} else {
+		record = &expiryRecord{key: key, kind: kind, value: value, deadline: deadline}
+		queue.records[key] = record
+		heap.Push(&queue.heap, record)
+	}
+	queue.updateNext()
+}
+
+// cancel removes the deadline for the object stored under the provided key,
+// if that object is the provided value.
+func (queue *expiryQueue) cancel(key string, value interface{}) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if record, ok := queue.records[key]; ok && record.value == value {
+		delete(queue.records, key)
+		heap.Remove(&queue.heap, record.index)
+		queue.updateNext()
+	}
+}
+
+// expired removes and returns the records whose deadlines are not after now.
+func (queue *expiryQueue) expired(now time.Time) []*expiryRecord {
+	next := atomic.LoadInt64(&queue.next)
+	if next == 0 || next > now.UnixNano() {
+		return nil
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	var expired []*expiryRecord
+	for len(queue.heap) != 0 && !queue.heap[0].deadline.After(now) {
+		record := heap.Pop(&queue.heap).(*expiryRecord)
+		delete(queue.records, record.key)
+		expired = append(expired, record)
+	}
+	queue.updateNext()
+	return expired
+}
+
+// encryptionDeadline returns the time at which an encryption entry for the
+// provided timestamp expires: the end of the hour containing the timestamp,
+// which is the granularity of a TimePath, plus the grace period.
+func (state *ClientState) encryptionDeadline(timestamp time.Time) time.Time {
+	return timestamp.Truncate(time.Hour).Add(time.Hour + state.encryptionGrace)
+}
+
+// ExpireEntries evicts the entries in the cache that have expired, as
+// configured by the WithEncryptionExpiry and WithDecryptionTTL options. This
+// happens automatically when the cache is accessed; an application need only
+// call this function if a ClientState may be idle for a long time, but its
+// expired keys should still be dropped from memory promptly.
+func (state *ClientState) ExpireEntries() {
+	if state.expiry == nil {
+		return
+	}
+	for _, record := range state.expiry.expired(time.Now()) {
+		state.cache.Evict(state.loader, record.kind, record.key)
+	}
+}
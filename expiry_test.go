@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpiryQueue(t *testing.T) {
+	queue := newExpiryQueue()
+	now := time.Now()
+	a, b, c := new(int), new(int), new(int)
+
+	queue.schedule("a", CacheKindEncryption, a, now.Add(2*time.Second))
+	queue.schedule("b", CacheKindDecryption, b, now.Add(time.Second))
+	queue.schedule("c", CacheKindDecryption, c, now.Add(3*time.Second))
+
+	/* Rescheduling replaces the earlier deadline. */
+	queue.schedule("a", CacheKindEncryption, a, now.Add(4*time.Second))
+
+	/* Cancelling with a different value has no effect. */
+	queue.cancel("c", a)
+	queue.cancel("b", b)
+
+	if expired := queue.expired(now); len(expired) != 0 {
+		t.Fatalf("Expected no expired records, got %d", len(expired))
+	}
+	expired := queue.expired(now.Add(5 * time.Second))
+	if len(expired) != 2 || expired[0].key != "c" || expired[1].key != "a" {
+		t.Fatal("Records expired in the wrong order")
+	}
+	if expired = queue.expired(now.Add(time.Hour)); len(expired) != 0 {
+		t.Fatal("Records expired twice")
+	}
+}
+
+func TestEncryptionExpiry(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithEncryptionExpiry(time.Minute), WithObserver(metrics))
+	ctx := context.Background()
+	now := time.Now()
+	past := now.Add(-2 * time.Hour)
+
+	/* The entry for the current hour must survive. */
+	for i := 0; i != 2; i++ {
+		if _, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := metrics.CacheStats(CacheKindEncryption); stats.Misses != 1 || stats.Evictions != 0 {
+		t.Fatalf("Unexpected encryption cache stats: %+v", stats)
+	}
+
+	/* The entry for a past hour expires as soon as it is populated. */
+	if _, err = state.Encrypt(ctx, TestHierarchy, "d/e/f", past, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	state.ExpireEntries()
+	if stats := metrics.CacheStats(CacheKindEncryption); stats.Misses != 2 || stats.Evictions != 1 {
+		t.Fatalf("Unexpected encryption cache stats: %+v", stats)
+	}
+	if _, err = state.Encrypt(ctx, TestHierarchy, "d/e/f", past, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := metrics.CacheStats(CacheKindEncryption); stats.Misses != 3 {
+		t.Fatalf("Expected the expired entry to be reloaded: %+v", stats)
+	}
+}
+
+func TestDecryptionTTL(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithDecryptionTTL(time.Nanosecond), WithObserver(metrics))
+	ctx := context.Background()
+	now := time.Now()
+
+	var encrypted []byte
+	if encrypted, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 2; i++ {
+		var decrypted []byte
+		if decrypted, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != quote1 {
+			t.Fatal("Original and decrypted messages differ")
+		}
+	}
+
+	if stats := metrics.CacheStats(CacheKindDecryption); stats.Misses != 2 || stats.Evictions != 1 {
+		t.Fatalf("Unexpected decryption cache stats: %+v", stats)
+	}
+	if stats := metrics.CacheStats(CacheKindEncryption); stats.Evictions != 0 {
+		t.Fatalf("Encryption entry was expired: %+v", stats)
+	}
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GatewayMessage is a JEDI-encrypted message, together with the URI and
+// time needed to decrypt it, as delivered by the underlying transport.
+type GatewayMessage struct {
+	URI        string
+	Timestamp  time.Time
+	Ciphertext []byte
+}
+
+// GatewaySubscriber represents the underlying transport's interface for
+// receiving messages. Like KeyStoreReader, it is meant to be implemented by
+// the calling application.
+type GatewaySubscriber interface {
+	// Subscribe subscribes to messages published in the hierarchy on URIs
+	// matching the provided URI pattern, which may contain "+" and a
+	// trailing "*" wildcard. Messages are delivered on the returned channel
+	// until it is closed or ctx is cancelled.
+	Subscribe(ctx context.Context, hierarchy []byte, uriPattern string) (<-chan GatewayMessage, error)
+}
+
+// GatewayPublisher represents the underlying transport's interface for
+// sending messages. Like KeyStoreReader, it is meant to be implemented by the
+// calling application.
+type GatewayPublisher interface {
+	// Publish publishes a JEDI-encrypted message in the hierarchy on the
+	// provided URI.
+	Publish(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, ciphertext []byte) error
+}
+
+// GatewayAuditRecord describes one message that a Gateway attempted to
+// bridge. It does not contain the message's plaintext.
+type GatewayAuditRecord struct {
+	Bridged        time.Time
+	Timestamp      time.Time
+	SourceURI      string
+	DestinationURI string
+	Size           int
+	Err            error
+}
+
+// GatewayAuditor receives an audit record for each message that a Gateway
+// attempts to bridge. It is meant to be implemented by the calling
+// application, which decides how the records are stored.
+type GatewayAuditor interface {
+	Record(ctx context.Context, record *GatewayAuditRecord)
+}
+
+// GatewayRule describes which URIs a Gateway bridges, and how it rewrites
+// them. Source is a URI pattern in the source hierarchy, which may contain
+// "+" components and a trailing "*". Destination is the URI in the
+// destination hierarchy; each "+" in it is replaced with the component
+// matched by the corresponding "+" in Source, and a trailing "*" is replaced
+// with the components matched by the "*" in Source. For example, the rule
+// with Source "orgA/+/sensors/*" and Destination "orgB/shared/+/*" bridges
+// "orgA/bldg1/sensors/temp/1" to "orgB/shared/bldg1/temp/1".
+type GatewayRule struct {
+	Source      string
+	Destination string
+}
+
+// compiledGatewayRule is a GatewayRule split into URI components.
+type compiledGatewayRule struct {
+	source      []string
+	destination []string
+	prefix      bool
+}
+
+// splitURI splits a URI into its components, as in ParseURI.
+func splitURI(uri string) []string {
+	rawComponents := strings.Split(uri, "/")
+	components := make([]string, 0, len(rawComponents))
+	for _, rawComponent := range rawComponents {
+		if rawComponent != "" {
+			components = append(components, rawComponent)
+		}
+	}
+	return components
+}
+
+func countWildcards(components []string) int {
+	count := 0
+	for _, component := range components {
+		if component == "+" {
+			count++
+		}
+	}
+	return count
+}
+
+func compileGatewayRule(rule GatewayRule) (*compiledGatewayRule, error) {
+	if _, err := ParseURI(rule.Source); err != nil {
+		return nil, err
+	}
+	if _, err := ParseURI(rule.Destination); err != nil {
+		return nil, err
+	}
+
+	compiled := &compiledGatewayRule{
+		source:      splitURI(rule.Source),
+		destination: splitURI(rule.Destination),
+	}
+	if len(compiled.source) == 0 || len(compiled.destination) == 0 {
+		return nil, errors.New("gateway rule URIs must be nonempty")
+	}
+
+	compiled.prefix = compiled.source[len(compiled.source)-1] == "*"
+	destinationPrefix := compiled.destination[len(compiled.destination)-1] == "*"
+	if compiled.prefix != destinationPrefix {
+		return nil, fmt.Errorf("gateway rule %s -> %s must use '*' in both URIs or in neither", rule.Source, rule.Destination)
+	}
+	if countWildcards(compiled.destination) > countWildcards(compiled.source) {
+		return nil, fmt.Errorf("gateway rule %s -> %s has more '+' components in the destination than in the source", rule.Source, rule.Destination)
+	}
+
+	return compiled, nil
+}
+
+// rewrite returns the destination URI for the provided source URI, and a
+// boolean indicating whether the source URI matches this rule.
+func (rule *compiledGatewayRule) rewrite(uri string) (string, bool) {
+	components := splitURI(uri)
+
+	fixed := rule.source
+	if rule.prefix {
+		fixed = fixed[:len(fixed)-1]
+		if len(components) < len(fixed) {
+			return "", false
+		}
+	} else if len(components) != len(fixed) {
+		return "", false
+	}
+
+	captured := make([]string, 0, len(fixed))
+	for i, component := range fixed {
+		if component == "+" {
+			captured = append(captured, components[i])
+		} else if component != components[i] {
+			return "", false
+		}
+	}
+
+	rewritten := make([]string, 0, len(rule.destination)+len(components)-len(fixed))
+	for _, component := range rule.destination {
+		switch component {
+		case "+":
+			rewritten = append(rewritten, captured[0])
+			captured = captured[1:]
+		case "*":
+			rewritten = append(rewritten, components[len(fixed):]...)
+		default:
+			rewritten = append(rewritten, component)
+		}
+	}
+	return strings.Join(rewritten, "/"), true
+}
+
+// GatewayConfig describes the configuration of a Gateway.
+type GatewayConfig struct {
+	// Source is the ClientState used to decrypt messages in the source
+	// hierarchy. Its key store must contain keys delegated to the gateway
+	// for the URIs it bridges.
+	Source          *ClientState
+	SourceHierarchy []byte
+
+	// Destination is the ClientState used to encrypt messages in the
+	// destination hierarchy.
+	Destination          *ClientState
+	DestinationHierarchy []byte
+
+	Rules      []GatewayRule
+	Subscriber GatewaySubscriber
+	Publisher  GatewayPublisher
+	Auditor    GatewayAuditor
+}
+
+// Gateway bridges messages from one hierarchy to another. It subscribes to
+// URIs in the source hierarchy, decrypts each message using keys delegated to
+// it, and re-encrypts the message under a rewritten URI in the destination
+// hierarchy. Plaintexts exist only in memory, and are overwritten once the
+// message has been re-encrypted.
+type Gateway struct {
+	config GatewayConfig
+	rules  []*compiledGatewayRule
+}
+
+// NewGateway creates a new Gateway with the provided configuration.
+func NewGateway(config GatewayConfig) (*Gateway, error) {
+	if config.Source == nil || config.Destination == nil {
+		return nil, errors.New("gateway requires source and destination client states")
+	}
+	if config.Subscriber == nil || config.Publisher == nil {
+		return nil, errors.New("gateway requires a subscriber and a publisher")
+	}
+	if config.Auditor == nil {
+		return nil, errors.New("gateway requires an auditor")
+	}
+
+	gateway := &Gateway{
+		config: config,
+		rules:  make([]*compiledGatewayRule, len(config.Rules)),
+	}
+	for i, rule := range config.Rules {
+		compiled, err := compileGatewayRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		gateway.rules[i] = compiled
+	}
+	return gateway, nil
+}
+
+// Run subscribes to the source URI of each rule, and bridges messages until
+// ctx is cancelled or all subscriptions are closed. Errors in bridging
+// individual messages are reported to the auditor, and do not stop the
+// gateway.
+func (gateway *Gateway) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages := make(chan GatewayMessage)
+	done := make(chan struct{}, len(gateway.config.Rules))
+	for _, rule := range gateway.config.Rules {
+		subscription, err := gateway.config.Subscriber.Subscribe(ctx, gateway.config.SourceHierarchy, rule.Source)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case message, ok := <-subscription:
+					if !ok {
+						return
+					}
+					select {
+					case messages <- message:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	for open := len(gateway.config.Rules); open != 0; {
+		select {
+		case message := <-messages:
+			gateway.Bridge(ctx, &message)
+		case <-done:
+			open--
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Bridge bridges a single message from the source hierarchy to the
+// destination hierarchy, using the first rule that matches the message's
+// URI. It returns the URI to which the message was published.
+func (gateway *Gateway) Bridge(ctx context.Context, message *GatewayMessage) (string, error) {
+	record := &GatewayAuditRecord{
+		Timestamp: message.Timestamp,
+		SourceURI: message.URI,
+	}
+	err := gateway.bridge(ctx, message, record)
+	record.Bridged = time.Now()
+	record.Err = err
+	gateway.config.Auditor.Record(ctx, record)
+	return record.DestinationURI, err
+}
+
+func (gateway *Gateway) bridge(ctx context.Context, message *GatewayMessage, record *GatewayAuditRecord) error {
+	var destinationURI string
+	matched := false
+	for _, rule := range gateway.rules {
+		if destinationURI, matched = rule.rewrite(message.URI); matched {
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("no gateway rule matches URI %s", message.URI)
+	}
+	record.DestinationURI = destinationURI
+
+	plaintext, err := gateway.config.Source.Decrypt(ctx, gateway.config.SourceHierarchy, message.URI, message.Timestamp, message.Ciphertext)
+	if err != nil {
+		return err
+	}
+	record.Size = len(plaintext)
+
+	ciphertext, err := gateway.config.Destination.Encrypt(ctx, gateway.config.DestinationHierarchy, destinationURI, message.Timestamp, plaintext)
+	zeroBytes(plaintext)
+	if err != nil {
+		return err
+	}
+
+	return gateway.config.Publisher.Publish(ctx, gateway.config.DestinationHierarchy, destinationURI, message.Timestamp, ciphertext)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testGatewayTransport struct {
+	lock      sync.Mutex
+	published []GatewayMessage
+	records   []*GatewayAuditRecord
+	incoming  chan GatewayMessage
+}
+
+func (tgt *testGatewayTransport) Subscribe(ctx context.Context, hierarchy []byte, uriPattern string) (<-chan GatewayMessage, error) {
+	return tgt.incoming, nil
+}
+
+func (tgt *testGatewayTransport) Publish(ctx context.Context, hierarchy []byte, uri string, timestamp time.Time, ciphertext []byte) error {
+	tgt.lock.Lock()
+	defer tgt.lock.Unlock()
+	tgt.published = append(tgt.published, GatewayMessage{URI: uri, Timestamp: timestamp, Ciphertext: ciphertext})
+	return nil
+}
+
+func (tgt *testGatewayTransport) Record(ctx context.Context, record *GatewayAuditRecord) {
+	tgt.lock.Lock()
+	defer tgt.lock.Unlock()
+	tgt.records = append(tgt.records, record)
+}
+
+func TestGatewayRuleRewrite(t *testing.T) {
+	tests := []struct {
+		rule    GatewayRule
+		uri     string
+		rewrite string
+		matches bool
+	}{
+		{GatewayRule{"orgA/+/sensors/*", "orgB/shared/+/*"}, "orgA/bldg1/sensors/temp/1", "orgB/shared/bldg1/temp/1", true},
+		{GatewayRule{"orgA/+/sensors/*", "orgB/shared/+/*"}, "orgA/bldg1/lights/1", "", false},
+		{GatewayRule{"orgA/+/+", "orgB/+/x/+"}, "orgA/a/b", "orgB/a/x/b", true},
+		{GatewayRule{"orgA/+/+", "orgB/+/x/+"}, "orgA/a/b/c", "", false},
+		{GatewayRule{"orgA/*", "orgB/*"}, "orgA", "orgB", true},
+	}
+	for _, test := range tests {
+		compiled, err := compileGatewayRule(test.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewrite, matches := compiled.rewrite(test.uri)
+		if matches != test.matches || rewrite != test.rewrite {
+			t.Fatalf("Rule %v rewrote %s to (%s, %v), expected (%s, %v)", test.rule, test.uri, rewrite, matches, test.rewrite, test.matches)
+		}
+	}
+
+	for _, invalid := range []GatewayRule{{"orgA/*", "orgB"}, {"orgA/+", "orgB/+/+"}, {"orgA/*/b", "orgB/*"}} {
+		if _, err := compileGatewayRule(invalid); err == nil {
+			t.Fatalf("No error for invalid rule %v", invalid)
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	var err error
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	sourceInfo, sourceStore := NewTestKeyStore()
+	destinationInfo, destinationStore := NewTestKeyStore()
+	source := NewClientState(sourceInfo, sourceStore, encoder, 1<<20)
+	destination := NewClientState(destinationInfo, destinationStore, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	transport := &testGatewayTransport{incoming: make(chan GatewayMessage, 2)}
+	gateway, err := NewGateway(GatewayConfig{
+		Source:               source,
+		SourceHierarchy:      []byte("orgA"),
+		Destination:          destination,
+		DestinationHierarchy: []byte("orgB"),
+		Rules:                []GatewayRule{{"a/+/c/*", "b/+/*"}},
+		Subscriber:           transport,
+		Publisher:            transport,
+		Auditor:              transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertext []byte
+	if ciphertext, err = source.Encrypt(ctx, []byte("orgA"), "a/x/c/d", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	transport.incoming <- GatewayMessage{URI: "a/x/c/d", Timestamp: now, Ciphertext: ciphertext}
+	transport.incoming <- GatewayMessage{URI: "z/x/c/d", Timestamp: now, Ciphertext: ciphertext}
+	close(transport.incoming)
+
+	if err = gateway.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transport.published) != 1 || transport.published[0].URI != "b/x/d" {
+		t.Fatalf("Unexpected published messages: %v", transport.published)
+	}
+	var decrypted []byte
+	if decrypted, err = destination.Decrypt(ctx, []byte("orgB"), "b/x/d", now, transport.published[0].Ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and bridged messages differ")
+	}
+
+	if len(transport.records) != 2 || transport.records[0].Err != nil || transport.records[1].Err == nil {
+		t.Fatalf("Unexpected audit records: %v", transport.records)
+	}
+}
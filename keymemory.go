@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/cryptutils"
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+// keyMaterial holds the secret values cached for a single WKD-IBE plaintext:
+// the plaintext itself, from which keys for any cipher suite can be derived,
+// and the AES-CTR key derived from it. It contains no pointers, so that it
+// can be stored in a keyPool.
+type keyMaterial struct {
+	key         [AESKeySize]byte
+	encryptable cryptutils.Encryptable
+}
+
+// keyPool is a fixed number of keyMaterial slots whose memory is locked into
+// RAM when the pool is created, so that the keys stored in them are never
+// written to swap. Locking one region up front bounds the memory that a
+// ClientState locks. Locking memory for each key as it is cached instead
+// would let anyone who can get keys cached (e.g., by sending ciphertexts)
+// exhaust the process's limit on locked memory.
+type keyPool struct {
+	lock   sync.Mutex
+	slots  []keyMaterial
+	free   []*keyMaterial
+	closed bool
+}
+
+// newKeyPool allocates a pool of the provided number of slots and locks it
+// into RAM. If the memory cannot be locked, the returned pool has no slots.
+func newKeyPool(size int) *keyPool {
+	pool := new(keyPool)
+	if size <= 0 {
+		return pool
+	}
+	slots := make([]keyMaterial, size)
+	if err := mlock(uintptr(unsafe.Pointer(&slots[0])), uintptr(size)*unsafe.Sizeof(slots[0])); err != nil {
+		return pool
+	}
+	pool.slots = slots
+	pool.free = make([]*keyMaterial, size)
+	for i := range slots {
+		pool.free[i] = &slots[i]
+	}
+	return pool
+}
+
+// get returns a free slot in the pool, and true. If there are no free slots,
+// it returns newly allocated memory that is not locked, and false.
+func (pool *keyPool) get() (*keyMaterial, bool) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if len(pool.free) == 0 || pool.closed {
+		return new(keyMaterial), false
+	}
+	material := pool.free[len(pool.free)-1]
+	pool.free = pool.free[:len(pool.free)-1]
+	return material, true
+}
+
+// put wipes material, and returns it to the pool if it is one of the pool's
+// slots.
+func (pool *keyPool) put(material *keyMaterial) {
+	*material = keyMaterial{}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.contains(material) && !pool.closed {
+		pool.free = append(pool.free, material)
+	}
+}
+
+// contains returns true if material is one of the pool's slots.
+func (pool *keyPool) contains(material *keyMaterial) bool {
+	if len(pool.slots) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(&pool.slots[0]))
+	end := uintptr(unsafe.Pointer(&pool.slots[len(pool.slots)-1]))
+	address := uintptr(unsafe.Pointer(material))
+	return address >= start && address <= end
+}
+
+// close wipes every slot in the pool and unlocks its memory.
+func (pool *keyPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	pool.free = nil
+	if len(pool.slots) != 0 {
+		for i := range pool.slots {
+			pool.slots[i] = keyMaterial{}
+		}
+		munlock(uintptr(unsafe.Pointer(&pool.slots[0])), uintptr(len(pool.slots))*unsafe.Sizeof(pool.slots[0]))
+	}
+}
+
+// newKeyMaterial returns memory in which to store a WKD-IBE plaintext and the
+// keys derived from it. If the ClientState was configured with
+// WithLockedMemory, the memory comes from its pool of locked memory if
+// possible; otherwise, the use of unlocked memory is reported to the
+// observer.
+func (state *ClientState) newKeyMaterial() *keyMaterial {
+	if state.keys == nil {
+		return new(keyMaterial)
+	}
+	material, locked := state.keys.get()
+	if !locked && state.observer != nil {
+		state.observer.UnlockedKeyMemory()
+	}
+	return material
+}
+
+// releaseKeyMaterial wipes memory obtained from newKeyMaterial, which must no
+// longer be used. It does nothing if material is nil.
+func (state *ClientState) releaseKeyMaterial(material *keyMaterial) {
+	if material == nil {
+		return
+	}
+	if state.keys == nil {
+		*material = keyMaterial{}
+		return
+	}
+	state.keys.put(material)
+}
+
+// zeroBytes overwrites buf with zeros. It is used to wipe copies of keys
+// once they are no longer needed.
+func zeroBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// wipeEncryptable overwrites a WKD-IBE plaintext with zeros.
+func wipeEncryptable(encryptable *cryptutils.Encryptable) {
+	*encryptable = cryptutils.Encryptable{}
+}
+
+// wipeSecretKey overwrites a WKD-IBE secret key with zeros.
+func wipeSecretKey(secretKey *wkdibe.SecretKey) {
+	*secretKey = wkdibe.SecretKey{}
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// liveEntries returns the objects that state has in its cache.
+func liveEntries(state *ClientState) map[string]interface{} {
+	loader := state.loader
+	loader.lock.Lock()
+	defer loader.lock.Unlock()
+
+	entries := make(map[string]interface{}, len(loader.live))
+	for key, value := range loader.live {
+		entries[key] = value
+	}
+	return entries
+}
+
+// checkWiped fails the test if a cache entry still holds key material. The
+// materials are the entry's key material as of before it was wiped.
+func checkWiped(t *testing.T, value interface{}, material *keyMaterial) {
+	switch entry := value.(type) {
+	case *encryptionCacheEntry:
+		if !entry.wiped || entry.slots != nil {
+			t.Fatal("Encryption cache entry was not wiped")
+		}
+	case *decryptionCacheEntry:
+		if !entry.wiped || entry.populated || entry.material != nil {
+			t.Fatal("Decryption cache entry was not wiped")
+		}
+	case *qualifiedKeyCacheEntry:
+		if entry.key != nil {
+			t.Fatal("Qualified key was not wiped")
+		}
+	}
+	if material != nil && *material != (keyMaterial{}) {
+		t.Fatal("Key material was not zeroed")
+	}
+}
+
+// entryMaterial returns the key material held by a cache entry, if any.
+func entryMaterial(value interface{}) *keyMaterial {
+	switch entry := value.(type) {
+	case *encryptionCacheEntry:
+		return entry.slots[0].material
+	case *decryptionCacheEntry:
+		return entry.material
+	}
+	return nil
+}
+
+func TestEvictedEntriesWiped(t *testing.T) {
+	state := NewTestState()
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+
+	entries := liveEntries(state)
+	materials := make(map[string]*keyMaterial)
+	for key, value := range entries {
+		material := entryMaterial(value)
+		if material != nil && *material == (keyMaterial{}) {
+			t.Fatal("Cached key material is empty")
+		}
+		materials[key] = material
+		state.cache.Evict(state.loader, cacheKindOf(key), key)
+	}
+	if len(liveEntries(state)) != 0 {
+		t.Fatal("Evicted entries are still tracked")
+	}
+	for key, value := range entries {
+		checkWiped(t, value, materials[key])
+	}
+
+	/* The ClientState should reload what it needs. */
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote2)
+}
+
+func TestWipedEntriesNotRetried(t *testing.T) {
+	state := NewTestState()
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+
+	/*
+	 * Wipe the entries without removing them from the cache, as if they were
+	 * evicted between being looked up and being used. Encryption and
+	 * decryption must fall back to not using the cache, rather than looking
+	 * the entries up again.
+	 */
+	for _, value := range liveEntries(state) {
+		state.wipeCacheEntry(value)
+	}
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote2)
+}
+
+func TestTinyCache(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(info, store, encoder, 1)
+	now := time.Now()
+
+	for i := 0; i != 4; i++ {
+		testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+	}
+}
+
+func TestClose(t *testing.T) {
+	state := NewTestState()
+	ctx := context.Background()
+	now := time.Now()
+
+	encrypted, err := state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := liveEntries(state)
+	materials := make(map[string]*keyMaterial)
+	for key, value := range entries {
+		materials[key] = entryMaterial(value)
+	}
+
+	state.Close()
+	if len(liveEntries(state)) != 0 {
+		t.Fatal("Entries remain after Close")
+	}
+	for key, value := range entries {
+		checkWiped(t, value, materials[key])
+	}
+
+	if _, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); !errors.Is(err, ErrClientStateClosed) {
+		t.Fatalf("Encrypt after Close returned %v", err)
+	}
+	if _, err = state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); !errors.Is(err, ErrClientStateClosed) {
+		t.Fatalf("Decrypt after Close returned %v", err)
+	}
+}
+
+func TestLockedMemory(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics), WithLockedMemory(8))
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+
+	locked := len(state.keys.slots) != 0
+	if locked && metrics.UnlockedKeys() != 0 {
+		t.Fatalf("%d keys stored in unlocked memory", metrics.UnlockedKeys())
+	}
+	if !locked && metrics.UnlockedKeys() == 0 {
+		t.Fatal("Keys stored in unlocked memory were not reported")
+	}
+	if locked {
+		for _, value := range liveEntries(state) {
+			if material := entryMaterial(value); material != nil && !state.keys.contains(material) {
+				t.Fatal("Key material is not in the locked pool")
+			}
+		}
+	}
+
+	state.Close()
+	for i := range state.keys.slots {
+		if state.keys.slots[i] != (keyMaterial{}) {
+			t.Fatal("Locked memory was not wiped")
+		}
+	}
+}
+
+func TestLockedMemoryFull(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics), WithLockedMemory(1))
+	now := time.Now()
+
+	/* Two URIs need at least four keys, which don't fit in the pool. */
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+	testMessageTransfer(t, state, TestHierarchy, "a/b/d", now, quote2)
+	if metrics.UnlockedKeys() == 0 {
+		t.Fatal("Keys stored in unlocked memory were not reported")
+	}
+
+	/* Evicting the entries returns their slots to the pool. */
+	for key := range liveEntries(state) {
+		state.cache.Evict(state.loader, cacheKindOf(key), key)
+	}
+	if len(state.keys.free) != len(state.keys.slots) {
+		t.Fatal("Slots of evicted entries were not returned to the pool")
+	}
+
+	state.Close()
+	if len(state.keys.free) != 0 {
+		t.Fatal("Closed pool has free slots")
+	}
+}
@@ -34,11 +34,17 @@ package jedi
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
 )
 
+// ErrKeyNotFound is returned when decrypting a message for which the key store
+// has no suitable key.
+var ErrKeyNotFound = errors.New("could not find suitable key for decryption: requisite delegation(s) not received")
+
 // KeyStoreReader represents a read-only interface to a key store that can be
 // used with JEDI. It represents the interface that a key store must support
 // so that JEDI can properly read from it when encrypting messages, decrypting
@@ -73,6 +79,52 @@ type PublicInfoReader interface {
 	ParamsForHierarchy(ctx context.Context, hierarchy []byte) (*wkdibe.Params, error)
 }
 
+// ParamEpoch is one version of the WKD-IBE public parameters for a hierarchy.
+// Each JEDI ciphertext records the epoch of the parameters it was produced
+// under.
+type ParamEpoch struct {
+	// Epoch identifies this version of the parameters. Newer versions have
+	// larger epochs.
+	Epoch uint32
+
+	// Params are the WKD-IBE public parameters.
+	Params *wkdibe.Params
+
+	// Retired is the end of the overlap period of these parameters, after
+	// which ciphertexts produced under them are no longer decrypted. The
+	// zero time means that they are decrypted indefinitely.
+	Retired time.Time
+}
+
+// VersionedPublicInfoReader is a PublicInfoReader that can report several
+// epochs of public parameters for each hierarchy, so that the parameters can
+// be rotated. New messages are encrypted under the newest epoch, and messages
+// are decrypted under any epoch that has not been retired. If a
+// ClientState's PublicInfoReader does not implement this interface, then
+// ParamsForHierarchy is used as the only epoch, numbered 0.
+//
+// A ClientState caches the epochs of each hierarchy. Call its
+// InvalidateHierarchy function after adding or retiring an epoch.
+type VersionedPublicInfoReader interface {
+	PublicInfoReader
+
+	// ParamEpochsForHierarchy retrieves the epochs of public parameters that
+	// are in use for a hierarchy, in any order.
+	ParamEpochsForHierarchy(ctx context.Context, hierarchy []byte) ([]ParamEpoch, error)
+}
+
+// VersionedKeyStoreReader is a KeyStoreReader that can retrieve keys for the
+// public parameters of a specific epoch. A ClientState whose PublicInfoReader
+// implements VersionedPublicInfoReader needs one to decrypt messages produced
+// under older epochs; otherwise, KeyForPattern is used for every epoch.
+type VersionedKeyStoreReader interface {
+	KeyStoreReader
+
+	// KeyForPatternInEpoch is like KeyForPattern, but retrieves a key for
+	// the public parameters of the provided epoch.
+	KeyForPatternInEpoch(ctx context.Context, hierarchy []byte, epoch uint32, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error)
+}
+
 // PatternType describes a type of permission encoded by a pattern.
 type PatternType int
 
@@ -92,6 +144,18 @@ type PatternEncoder interface {
 	Encode(uriPath URIPath, timePath TimePath, patternType PatternType) Pattern
 }
 
+// PatternLengthEncoder is a PatternEncoder that reports the length of the
+// patterns that it produces. A ClientState uses it, if its PatternEncoder
+// implements it, to check patterns from untrusted parties; otherwise, it
+// learns the length by encoding a URI and time the first time it is needed.
+type PatternLengthEncoder interface {
+	PatternEncoder
+
+	// PatternLength returns the number of components in each pattern
+	// produced by Encode.
+	PatternLength() int
+}
+
 // DefaultPatternEncoder is a simple pattern encoding that will likely be
 // suitable for many applications.
 type DefaultPatternEncoder struct {
@@ -106,6 +170,12 @@ func NewDefaultPatternEncoder(maxURILength int) *DefaultPatternEncoder {
 	}
 }
 
+// PatternLength returns the number of components in each pattern produced by
+// the default encoding.
+func (dpe *DefaultPatternEncoder) PatternLength() int {
+	return dpe.patternLength
+}
+
 // Prefixes attached to each component of a pattern encoded with the default
 // encoding.
 const (
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+
+	"github.com/samkumar/reqcache"
+)
+
+// CacheConfig configures a cache created with NewLRUCache.
+type CacheConfig struct {
+	// Capacity is the memory capacity (in bytes) shared by all kinds of
+	// objects that do not have their own budget.
+	Capacity uint64
+
+	// Budgets reserves a separate memory capacity (in bytes) for particular
+	// kinds of objects. Objects of a kind with its own budget are evicted
+	// only to make room for other objects of the same kind, so that, for
+	// example, a flood of one-off decryptions cannot evict the entries that
+	// accelerate encryption. A budget of zero means that objects of that
+	// kind are not retained after they are used.
+	Budgets map[CacheKind]uint64
+}
+
+// lruCache is the default implementation of Cache. It consists of an LRU
+// cache shared by most kinds of objects, and a separate LRU cache for each
+// kind of object with its own budget.
+type lruCache struct {
+	shared     *reqcache.LRUCache
+	partitions [numCacheKinds]*reqcache.LRUCache
+}
+
+// lruCacheKey identifies an object in an lruCache. Including the loader
+// keeps objects stored by different ClientStates separate.
+type lruCacheKey struct {
+	loader CacheLoader
+	key    string
+}
+
+// NewLRUCache creates a new Cache that evicts the least recently used objects
+// when its capacity, or the budget for a kind of object, is exceeded. It may
+// be shared by multiple ClientStates, using the WithCache option, to bound
+// their total memory usage.
+func NewLRUCache(config CacheConfig) Cache {
+	cache := new(lruCache)
+	cache.shared = newLRUPartition(config.Capacity)
+	for kind := range cache.partitions {
+		if budget, ok := config.Budgets[CacheKind(kind)]; ok {
+			cache.partitions[kind] = newLRUPartition(budget)
+		} else {
+			cache.partitions[kind] = cache.shared
+		}
+	}
+	return cache
+}
+
+func newLRUPartition(capacity uint64) *reqcache.LRUCache {
+	return reqcache.NewLRUCache(capacity,
+		func(ctx context.Context, key interface{}) (interface{}, uint64, error) {
+			k := key.(lruCacheKey)
+			return k.loader.Load(ctx, k.key)
+		},
+		func(evicted []*reqcache.LRUCacheEntry) {
+			for _, entry := range evicted {
+				k := entry.Key.(lruCacheKey)
+				k.loader.Evicted(k.key, entry.Value)
+			}
+		})
+}
+
+func (cache *lruCache) partition(kind CacheKind) *reqcache.LRUCache {
+	if kind >= 0 && kind < numCacheKinds {
+		return cache.partitions[kind]
+	}
+	return cache.shared
+}
+
+// Get implements the Cache interface.
+func (cache *lruCache) Get(ctx context.Context, loader CacheLoader, kind CacheKind, key string) (interface{}, error) {
+	return cache.partition(kind).Get(ctx, lruCacheKey{loader: loader, key: key})
+}
+
+// Evict implements the Cache interface.
+func (cache *lruCache) Evict(loader CacheLoader, kind CacheKind, key string) {
+	cache.partition(kind).Evict(lruCacheKey{loader: loader, key: key})
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSharedCache(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	cache := NewLRUCache(CacheConfig{Capacity: 1 << 20})
+	metrics := NewMetrics()
+	state1 := NewClientState(info, store, encoder, 0, WithCache(cache), WithObserver(metrics))
+	state2 := NewClientState(info, store, encoder, 0, WithCache(cache), WithObserver(metrics))
+	now := time.Now()
+
+	testMessageTransfer(t, state1, TestHierarchy, "a/b/c", now, quote1)
+	testMessageTransfer(t, state2, TestHierarchy, "a/b/c", now, quote2)
+
+	/* Each ClientState must load its own objects into the shared cache. */
+	if stats := metrics.CacheStats(CacheKindHierarchy); stats.Misses != 2 {
+		t.Fatalf("Expected two hierarchy cache misses, got %d", stats.Misses)
+	}
+	if stats := metrics.CacheStats(CacheKindQualifiedKey); stats.Misses != 2 {
+		t.Fatalf("Expected two qualified key cache misses, got %d", stats.Misses)
+	}
+}
+
+func TestCacheBudgets(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	ctx := context.Background()
+	now := time.Now()
+
+	cache := NewLRUCache(CacheConfig{
+		Capacity: 1,
+		Budgets:  map[CacheKind]uint64{CacheKindEncryption: 1 << 20},
+	})
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 0, WithCache(cache), WithObserver(metrics))
+	publisher := NewClientState(info, store, encoder, 1<<20)
+
+	if _, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Flood the cache with one-off decryptions. */
+	for i := 0; i != 10; i++ {
+		uri := fmt.Sprintf("a/b/c/%d", i)
+		var encrypted []byte
+		if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, uri, now, []byte(quote2)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = state.Decrypt(ctx, TestHierarchy, uri, now, encrypted); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = state.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := metrics.CacheStats(CacheKindDecryption); stats.Evictions == 0 {
+		t.Fatal("Expected decryption entries to be evicted")
+	}
+	if stats := metrics.CacheStats(CacheKindEncryption); stats.Evictions != 0 || stats.Hits != 1 {
+		t.Fatalf("Unexpected encryption cache stats: %+v", stats)
+	}
+	if stats := metrics.OperationStats(OperationPrepare); stats.Count != 1 {
+		t.Fatalf("Expected one prepare operation, got %d", stats.Count)
+	}
+}
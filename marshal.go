@@ -48,6 +48,14 @@ const (
 	MarshalledTypeInvalid = iota
 	MarshalledTypePattern
 	MarshalledTypeDelegation
+	MarshalledTypeBlob
+	MarshalledTypeEnvelope
+	MarshalledTypeSegment
+	MarshalledTypeProvisioningBundle
+	MarshalledTypeMultiEnvelope
+	MarshalledTypeOffloadRequest
+	MarshalledTypeOffloadResponse
+	MarshalledTypeEncryptionSnapshot
 )
 
 // Byte returns a byte representation of a MarshalledType.
@@ -61,7 +69,7 @@ func newMessageBuffer(cap int, marshalledType MarshalledType) []byte {
 }
 
 func checkMessageType(message []byte, expected MarshalledType) []byte {
-	if message[0] != expected.Byte() {
+	if len(message) == 0 || message[0] != expected.Byte() {
 		return nil
 	}
 	return message[1:]
@@ -88,6 +96,9 @@ func marshalAppendLength(length int, buf []byte) []byte {
 }
 
 func unmarshalPrefixLength(buf []byte) (int, []byte) {
+	if len(buf) < MarshalledLengthLength {
+		return 0, nil
+	}
 	length := getLength(buf[:MarshalledLengthLength])
 	buf = buf[MarshalledLengthLength:]
 	return length, buf
@@ -113,6 +124,9 @@ func marshalAppendWithLength(m Marshallable, buf []byte) []byte {
 
 func unmarshalPrefixWithLengthRaw(buf []byte) ([]byte, []byte) {
 	length, buf := unmarshalPrefixLength(buf)
+	if length > len(buf) {
+		return nil, nil
+	}
 	if length == 0 {
 		return nil, buf
 	}
@@ -178,6 +192,12 @@ func (p Pattern) Marshal() []byte {
 	return buf
 }
 
+// MaxMarshalledPatternLength is the maximum length of a Pattern that
+// Unmarshal accepts. Marshalled patterns may come from untrusted parties
+// before any signature on them is checked, so the length read from the wire
+// is bounded before a Pattern of that length is allocated.
+const MaxMarshalledPatternLength = 1024
+
 // Unmarshal decodes a Pattern from a byte slice encoded with Marshal().
 func (p *Pattern) Unmarshal(marshalled []byte) bool {
 	var buf []byte
@@ -186,7 +206,7 @@ func (p *Pattern) Unmarshal(marshalled []byte) bool {
 	}
 
 	var patternLength int
-	if patternLength, buf = unmarshalPrefixLength(buf); buf == nil {
+	if patternLength, buf = unmarshalPrefixLength(buf); buf == nil || patternLength > MaxMarshalledPatternLength {
 		return false
 	}
 
@@ -200,7 +220,7 @@ func (p *Pattern) Unmarshal(marshalled []byte) bool {
 
 	i := -1
 	for i != last {
-		if i, buf = unmarshalPrefixLength(buf); buf == nil {
+		if i, buf = unmarshalPrefixLength(buf); buf == nil || i >= patternLength {
 			return false
 		}
 
@@ -235,8 +255,22 @@ func (d *Delegation) Marshal() []byte {
 	return buf
 }
 
-// Unmarshal decodes a JEDI delegation from a byte array.
+// Unmarshal decodes a JEDI delegation from a byte array. Because delegations
+// are typically received over the network, it checks that the group elements
+// in the public parameters and keys are valid (i.e., on the curve and in the
+// correct subgroup), and fails if they are not.
 func (d *Delegation) Unmarshal(marshalled []byte) bool {
+	return d.unmarshal(marshalled, true)
+}
+
+// UnmarshalTrusted is the same as Unmarshal, but it skips checking that the
+// group elements in the delegation are valid. It should only be used for
+// delegations from a trusted source, such as the local key store.
+func (d *Delegation) UnmarshalTrusted(marshalled []byte) bool {
+	return d.unmarshal(marshalled, false)
+}
+
+func (d *Delegation) unmarshal(marshalled []byte, checked bool) bool {
 	var buf []byte
 	if buf = checkMessageType(marshalled, MarshalledTypeDelegation); buf == nil {
 		return false
@@ -253,7 +287,7 @@ func (d *Delegation) Unmarshal(marshalled []byte) bool {
 		return false
 	}
 	d.Params = new(wkdibe.Params)
-	if !d.Params.Unmarshal(marshalledParams.b, true, false) {
+	if !d.Params.Unmarshal(marshalledParams.b, true, checked) {
 		return false
 	}
 
@@ -274,7 +308,7 @@ func (d *Delegation) Unmarshal(marshalled []byte) bool {
 			return false
 		}
 		d.Keys[i] = new(wkdibe.SecretKey)
-		if !d.Keys[i].Unmarshal(marshalledKey.b, true, false) {
+		if !d.Keys[i].Unmarshal(marshalledKey.b, true, checked) {
 			return false
 		}
 	}
@@ -0,0 +1,344 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// CacheKind identifies the kind of object stored in a ClientState's cache.
+type CacheKind int
+
+// These constants identify each kind of object stored in the cache.
+const (
+	CacheKindHierarchy CacheKind = iota
+	CacheKindEncryption
+	CacheKindDecryption
+	CacheKindQualifiedKey
+	numCacheKinds
+)
+
+// String returns the name of a CacheKind, as used in exposed metrics.
+func (kind CacheKind) String() string {
+	switch kind {
+	case CacheKindHierarchy:
+		return "hierarchy"
+	case CacheKindEncryption:
+		return "encryption"
+	case CacheKindDecryption:
+		return "decryption"
+	case CacheKindQualifiedKey:
+		return "qualified"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(kind))
+	}
+}
+
+// CryptoOperation identifies an expensive cryptographic operation performed
+// by a ClientState.
+type CryptoOperation int
+
+// These constants identify each cryptographic operation that is observed.
+const (
+	OperationPrepare CryptoOperation = iota
+	OperationAdjust
+	OperationEncrypt
+	OperationDecrypt
+	OperationQualify
+	numCryptoOperations
+)
+
+// String returns the name of a CryptoOperation, as used in exposed metrics.
+func (op CryptoOperation) String() string {
+	switch op {
+	case OperationPrepare:
+		return "prepare"
+	case OperationAdjust:
+		return "adjust"
+	case OperationEncrypt:
+		return "encrypt"
+	case OperationDecrypt:
+		return "decrypt"
+	case OperationQualify:
+		return "qualify"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(op))
+	}
+}
+
+// Observer receives events describing the behavior of a ClientState's cache
+// and the cryptographic operations it performs. Its methods are called
+// synchronously from encryption and decryption, possibly concurrently, so
+// they must be safe for concurrent use and should return quickly.
+type Observer interface {
+	// CacheHit is called when a lookup finds an object in the cache.
+	CacheHit(kind CacheKind)
+
+	// CacheMiss is called when a lookup does not find an object in the
+	// cache, and it must be loaded.
+	CacheMiss(kind CacheKind)
+
+	// CacheInsert is called when an object of the provided size (in bytes)
+	// is loaded into the cache.
+	CacheInsert(kind CacheKind, size uint64)
+
+	// CacheEvict is called when an object of the provided size (in bytes)
+	// is evicted from the cache.
+	CacheEvict(kind CacheKind, size uint64)
+
+	// CryptoOperation is called after each cryptographic operation, with
+	// the time that it took.
+	CryptoOperation(op CryptoOperation, elapsed time.Duration)
+
+	// UnlockedKeyMemory is called when a ClientState configured with
+	// WithLockedMemory stores a key in memory that is not locked, because
+	// its pool of locked memory is full or could not be locked.
+	UnlockedKeyMemory()
+}
+
+// latencyBuckets are the upper bounds of the buckets of the latency
+// histograms kept by Metrics.
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// CacheStats summarizes the activity of the cache for one kind of object.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Bytes     uint64
+}
+
+// OperationStats summarizes the cryptographic operations of one type.
+type OperationStats struct {
+	Count uint64
+	Total time.Duration
+}
+
+type cacheCounters struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	inserted  uint64
+	evicted   uint64
+}
+
+type operationCounters struct {
+	count   uint64
+	nanos   uint64
+	buckets [len(latencyBuckets)]uint64 // Overflow is implied by count
+}
+
+// Metrics is an Observer that counts events in memory. It can be exposed in
+// the Prometheus text format by serving it over HTTP, since it implements
+// http.Handler. The zero value is ready to use, and a single Metrics may be
+// shared by multiple ClientStates.
+type Metrics struct {
+	cache        [numCacheKinds]cacheCounters
+	operations   [numCryptoOperations]operationCounters
+	unlockedKeys uint64
+}
+
+// NewMetrics creates a new Metrics instance with all counters set to zero.
+func NewMetrics() *Metrics {
+	return new(Metrics)
+}
+
+func (m *Metrics) cacheCounters(kind CacheKind) *cacheCounters {
+	if kind < 0 || kind >= numCacheKinds {
+		return nil
+	}
+	return &m.cache[kind]
+}
+
+// CacheHit implements the Observer interface.
+func (m *Metrics) CacheHit(kind CacheKind) {
+	if c := m.cacheCounters(kind); c != nil {
+		atomic.AddUint64(&c.hits, 1)
+	}
+}
+
+// CacheMiss implements the Observer interface.
+func (m *Metrics) CacheMiss(kind CacheKind) {
+	if c := m.cacheCounters(kind); c != nil {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// CacheInsert implements the Observer interface.
+func (m *Metrics) CacheInsert(kind CacheKind, size uint64) {
+	if c := m.cacheCounters(kind); c != nil {
+		atomic.AddUint64(&c.inserted, size)
+	}
+}
+
+// CacheEvict implements the Observer interface.
+func (m *Metrics) CacheEvict(kind CacheKind, size uint64) {
+	if c := m.cacheCounters(kind); c != nil {
+		atomic.AddUint64(&c.evictions, 1)
+		atomic.AddUint64(&c.evicted, size)
+	}
+}
+
+// CryptoOperation implements the Observer interface.
+func (m *Metrics) CryptoOperation(op CryptoOperation, elapsed time.Duration) {
+	if op < 0 || op >= numCryptoOperations {
+		return
+	}
+	o := &m.operations[op]
+	for i, bound := range latencyBuckets {
+		if elapsed <= bound {
+			atomic.AddUint64(&o.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&o.nanos, uint64(elapsed))
+	atomic.AddUint64(&o.count, 1)
+}
+
+// UnlockedKeyMemory implements the Observer interface.
+func (m *Metrics) UnlockedKeyMemory() {
+	atomic.AddUint64(&m.unlockedKeys, 1)
+}
+
+// UnlockedKeys returns the number of keys that were stored in memory that is
+// not locked, despite WithLockedMemory.
+func (m *Metrics) UnlockedKeys() uint64 {
+	return atomic.LoadUint64(&m.unlockedKeys)
+}
+
+// CacheStats returns the current statistics for one kind of cached object.
+// Bytes is the size of the objects of that kind currently in the cache.
+func (m *Metrics) CacheStats(kind CacheKind) CacheStats {
+	c := m.cacheCounters(kind)
+	if c == nil {
+		return CacheStats{}
+	}
+	evicted := atomic.LoadUint64(&c.evicted)
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Bytes:     atomic.LoadUint64(&c.inserted) - evicted,
+	}
+}
+
+// OperationStats returns the current statistics for one type of
+// cryptographic operation.
+func (m *Metrics) OperationStats(op CryptoOperation) OperationStats {
+	if op < 0 || op >= numCryptoOperations {
+		return OperationStats{}
+	}
+	o := &m.operations[op]
+	return OperationStats{
+		Count: atomic.LoadUint64(&o.count),
+		Total: time.Duration(atomic.LoadUint64(&o.nanos)),
+	}
+}
+
+// WriteText writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	cacheMetrics := []struct {
+		name       string
+		help       string
+		metricType string
+		value      func(CacheStats) uint64
+	}{
+		{"jedi_cache_hits_total", "Cache lookups that found the object.", "counter", func(s CacheStats) uint64 { return s.Hits }},
+		{"jedi_cache_misses_total", "Cache lookups that had to load the object.", "counter", func(s CacheStats) uint64 { return s.Misses }},
+		{"jedi_cache_evictions_total", "Objects evicted from the cache.", "counter", func(s CacheStats) uint64 { return s.Evictions }},
+		{"jedi_cache_bytes", "Size of the objects in the cache.", "gauge", func(s CacheStats) uint64 { return s.Bytes }},
+	}
+	for _, metric := range cacheMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.metricType); err != nil {
+			return err
+		}
+		for kind := CacheKind(0); kind != numCacheKinds; kind++ {
+			if _, err := fmt.Fprintf(w, "%s{kind=%q} %d\n", metric.name, kind.String(), metric.value(m.CacheStats(kind))); err != nil {
+				return err
+			}
+		}
+	}
+
+	const unlocked = "jedi_unlocked_keys_total"
+	if _, err := fmt.Fprintf(w, "# HELP %s Keys stored in memory that is not locked.\n# TYPE %s counter\n%s %d\n", unlocked, unlocked, unlocked, m.UnlockedKeys()); err != nil {
+		return err
+	}
+
+	const name = "jedi_crypto_operation_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Latency of cryptographic operations.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+	for op := CryptoOperation(0); op != numCryptoOperations; op++ {
+		o := &m.operations[op]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&o.buckets[i])
+			if _, err := fmt.Fprintf(w, "%s_bucket{operation=%q,le=\"%g\"} %d\n", name, op.String(), bound.Seconds(), cumulative); err != nil {
+				return err
+			}
+		}
+		stats := m.OperationStats(op)
+		if stats.Count < cumulative {
+			stats.Count = cumulative
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{operation=%q,le=\"+Inf\"} %d\n", name, op.String(), stats.Count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum{operation=%q} %g\n%s_count{operation=%q} %d\n", name, op.String(), stats.Total.Seconds(), name, op.String(), stats.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
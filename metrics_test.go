@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics))
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote2)
+
+	/* Each decryption looks up the hierarchy to check the epoch. */
+	expected := map[CacheKind]CacheStats{
+		CacheKindHierarchy:    {Hits: 3, Misses: 1},
+		CacheKindEncryption:   {Hits: 1, Misses: 1},
+		CacheKindDecryption:   {Hits: 1, Misses: 1},
+		CacheKindQualifiedKey: {Misses: 1},
+	}
+	for kind, want := range expected {
+		stats := metrics.CacheStats(kind)
+		if stats.Hits != want.Hits || stats.Misses != want.Misses || stats.Evictions != 0 {
+			t.Fatalf("Unexpected %v cache stats: %+v", kind, stats)
+		}
+		if stats.Bytes == 0 {
+			t.Fatalf("No bytes recorded for %v cache", kind)
+		}
+	}
+
+	for _, op := range []CryptoOperation{OperationPrepare, OperationEncrypt, OperationDecrypt, OperationQualify} {
+		if stats := metrics.OperationStats(op); stats.Count != 1 {
+			t.Fatalf("Expected one %v operation, got %d", op, stats.Count)
+		}
+	}
+	if stats := metrics.OperationStats(OperationAdjust); stats.Count != 0 {
+		t.Fatalf("Expected no adjust operations, got %d", stats.Count)
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"jedi_cache_hits_total{kind=\"encryption\"} 1\n",
+		"jedi_cache_misses_total{kind=\"qualified\"} 1\n",
+		"jedi_crypto_operation_seconds_bucket{operation=\"prepare\",le=\"+Inf\"} 1\n",
+		"jedi_crypto_operation_seconds_count{operation=\"decrypt\"} 1\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Exposition does not contain %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsEviction(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1, WithObserver(metrics))
+	now := time.Now()
+
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now, quote1)
+
+	for kind := CacheKind(0); kind != numCacheKinds; kind++ {
+		stats := metrics.CacheStats(kind)
+		if stats.Evictions == 0 || stats.Bytes != 0 {
+			t.Fatalf("Unexpected %v cache stats: %+v", kind, stats)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// MigrationItem is a stored JEDI ciphertext, together with the URI and time
+// needed to decrypt it.
+type MigrationItem struct {
+	ID         string
+	URI        string
+	Timestamp  time.Time
+	Ciphertext []byte
+}
+
+// MigrationSource provides the ciphertexts to migrate, in a deterministic
+// order so that a migration can be resumed from a checkpoint.
+type MigrationSource interface {
+	// Next returns the next item, or io.EOF if there are no more items.
+	Next(ctx context.Context) (*MigrationItem, error)
+}
+
+// MigrationSink receives migrated ciphertexts.
+type MigrationSink interface {
+	// Put stores a migrated item. The item's ID, URI, and Timestamp are the
+	// same as those of the original item.
+	Put(ctx context.Context, item *MigrationItem) error
+}
+
+// MigrationConfig describes how to migrate ciphertexts from one set of
+// hierarchy parameters to another.
+type MigrationConfig struct {
+	// From is the ClientState used to decrypt the original ciphertexts.
+	From          *ClientState
+	FromHierarchy []byte
+
+	// To is the ClientState used to encrypt the migrated ciphertexts.
+	To          *ClientState
+	ToHierarchy []byte
+
+	// Resume is the position (the number of items already handled) from
+	// which to resume a previous migration. Items before this position are
+	// read from the source, but are otherwise skipped.
+	Resume int64
+
+	// Checkpoint, if not nil, is called with the current position after
+	// every CheckpointInterval items, and once the migration finishes. Once
+	// it returns, every item before that position has been handled.
+	Checkpoint         func(position int64) error
+	CheckpointInterval int64
+}
+
+// MigrationFailure describes an item that could not be migrated.
+type MigrationFailure struct {
+	Position int64
+	ID       string
+	Err      error
+}
+
+// MigrationReport summarizes the result of a migration.
+type MigrationReport struct {
+	// Position is the number of items handled, including those skipped
+	// because of Resume, and can be used as Resume to continue later.
+	Position int64
+	Migrated int64
+	Failures []MigrationFailure
+}
+
+// Migrate streams ciphertexts from source, decrypts each one with the From
+// ClientState, re-encrypts it with the To ClientState, and writes the result
+// to sink. Items that cannot be decrypted or re-encrypted are recorded in the
+// returned report, and the migration continues past them. Errors from the
+// source, the sink, or the checkpoint function stop the migration; the
+// report is still returned so that the migration can be resumed.
+func Migrate(ctx context.Context, config *MigrationConfig, source MigrationSource, sink MigrationSink) (*MigrationReport, error) {
+	if config.From == nil || config.To == nil {
+		return nil, errors.New("migration requires From and To client states")
+	}
+
+	report := new(MigrationReport)
+	sinceCheckpoint := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		item, err := source.Next(ctx)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+
+		if report.Position >= config.Resume {
+			var migrated *MigrationItem
+			if migrated, err = migrateItem(ctx, config, item); err != nil {
+				report.Failures = append(report.Failures, MigrationFailure{
+					Position: report.Position,
+					ID:       item.ID,
+					Err:      err,
+				})
+			} else {
+				if err = sink.Put(ctx, migrated); err != nil {
+					return report, err
+				}
+				report.Migrated++
+			}
+		}
+		report.Position++
+
+		if config.Checkpoint != nil && config.CheckpointInterval != 0 {
+			if sinceCheckpoint++; sinceCheckpoint == config.CheckpointInterval {
+				if err = config.Checkpoint(report.Position); err != nil {
+					return report, err
+				}
+				sinceCheckpoint = 0
+			}
+		}
+	}
+
+	if config.Checkpoint != nil {
+		if err := config.Checkpoint(report.Position); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// migrateItem decrypts and re-encrypts a single item.
+func migrateItem(ctx context.Context, config *MigrationConfig, item *MigrationItem) (*MigrationItem, error) {
+	plaintext, err := config.From.Decrypt(ctx, config.FromHierarchy, item.URI, item.Timestamp, item.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := config.To.Encrypt(ctx, config.ToHierarchy, item.URI, item.Timestamp, plaintext)
+	zeroBytes(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MigrationItem{
+		ID:         item.ID,
+		URI:        item.URI,
+		Timestamp:  item.Timestamp,
+		Ciphertext: ciphertext,
+	}, nil
+}
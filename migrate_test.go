@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+type testMigrationCorpus struct {
+	items    []*MigrationItem
+	next     int
+	migrated []*MigrationItem
+}
+
+func (tmc *testMigrationCorpus) Next(ctx context.Context) (*MigrationItem, error) {
+	if tmc.next == len(tmc.items) {
+		return nil, io.EOF
+	}
+	item := tmc.items[tmc.next]
+	tmc.next++
+	return item, nil
+}
+
+func (tmc *testMigrationCorpus) Put(ctx context.Context, item *MigrationItem) error {
+	tmc.migrated = append(tmc.migrated, item)
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	oldInfo, oldStore := NewTestKeyStore()
+	newInfo, newStore := NewTestKeyStore()
+	from := NewClientState(oldInfo, oldStore, encoder, 1<<20)
+	to := NewClientState(newInfo, newStore, encoder, 1<<20)
+	start := time.Unix(1565119330, 0)
+	ctx := context.Background()
+
+	corpus := new(testMigrationCorpus)
+	messages := []string{quote1, quote2, quote1, quote2, quote1}
+	for i, message := range messages {
+		timestamp := start.Add(time.Duration(i) * time.Hour)
+		ciphertext, err := from.Encrypt(ctx, TestHierarchy, "a/b/c", timestamp, []byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus.items = append(corpus.items, &MigrationItem{ID: string(rune('A' + i)), URI: "a/b/c", Timestamp: timestamp, Ciphertext: ciphertext})
+	}
+	corpus.items[2].Ciphertext = corpus.items[2].Ciphertext[:10]
+
+	var checkpoints []int64
+	config := &MigrationConfig{
+		From:          from,
+		FromHierarchy: TestHierarchy,
+		To:            to,
+		ToHierarchy:   TestHierarchy,
+		Resume:        1,
+		Checkpoint: func(position int64) error {
+			checkpoints = append(checkpoints, position)
+			return nil
+		},
+		CheckpointInterval: 2,
+	}
+
+	report, err := Migrate(ctx, config, corpus, corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Position != 5 || report.Migrated != 3 || len(report.Failures) != 1 || report.Failures[0].ID != "C" {
+		t.Fatalf("Unexpected migration report: %+v", report)
+	}
+	if len(checkpoints) != 3 || checkpoints[0] != 2 || checkpoints[1] != 4 || checkpoints[2] != 5 {
+		t.Fatalf("Unexpected checkpoints: %v", checkpoints)
+	}
+
+	for _, item := range corpus.migrated {
+		index := int(item.ID[0] - 'A')
+		decrypted, err := to.Decrypt(ctx, TestHierarchy, item.URI, item.Timestamp, item.Ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte(messages[index])) {
+			t.Fatalf("Migrated item %s differs from the original", item.ID)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"time"
+)
+
+// These constants identify the keys used in a MultiEnvelope.
+const (
+	cipherSuiteAES128GCMWrap    = "AES-128-GCM-WRAP"
+	cipherSuiteAES128GCMPayload = "AES-128-GCM-PAYLOAD"
+)
+
+// MultiEnvelopeTarget identifies a hierarchy, and a URI in that hierarchy, to
+// which a message is encrypted with EncryptMulti.
+type MultiEnvelopeTarget struct {
+	Hierarchy []byte
+	URI       string
+}
+
+// MultiEnvelopeRecipient contains the data key of a MultiEnvelope, wrapped
+// for one target. EncryptedKey is the WKD-IBE ciphertext of a symmetric key
+// for the target's pattern, and WrappedKey is the encryption of the data key
+// under that symmetric key.
+type MultiEnvelopeRecipient struct {
+	Hierarchy    []byte
+	Pattern      Pattern
+	EncryptedKey []byte
+	WrappedKey   []byte
+}
+
+// MultiEnvelope is a message encrypted under several hierarchies at once.
+// The message is encrypted once, with a random data key, and the data key is
+// wrapped separately for each target hierarchy and URI.
+type MultiEnvelope struct {
+	Recipients []MultiEnvelopeRecipient
+	Ciphertext []byte
+}
+
+// EncryptMulti encrypts a message so that it can be decrypted by anyone who
+// could decrypt it under any one of the targets. The "timestamp" argument
+// has the same meaning as in Encrypt, and applies to all targets. As with
+// Encrypt, the WKD-IBE ciphertext for each target is cached and reused for
+// messages with the same URI and time.
+func (state *ClientState) EncryptMulti(ctx context.Context, targets []MultiEnvelopeTarget, timestamp time.Time, message []byte) (*MultiEnvelope, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no targets to encrypt to")
+	}
+
+	dataKey := make([]byte, AESKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	defer zeroBytes(dataKey)
+
+	envelope := &MultiEnvelope{
+		Recipients: make([]MultiEnvelopeRecipient, len(targets)),
+	}
+	for i, target := range targets {
+		uriPath, pattern, err := state.encodePattern(target.URI, timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		recipient := &envelope.Recipients[i]
+		recipient.Hierarchy = target.Hierarchy
+		recipient.Pattern = pattern
+		recipient.EncryptedKey = make([]byte, EncryptedKeySize)
+
+		var key [AESKeySize]byte
+		if key, err = state.encryptionKey(ctx, target.Hierarchy, uriPath, pattern, timestamp, cipherSuiteAES128CTR, recipient.EncryptedKey); err != nil {
+			return nil, err
+		}
+
+		var aead cipher.AEAD
+		aead, err = newSubkeyAEAD(key[:], nil, cipherSuiteAES128GCMWrap)
+		zeroBytes(key[:])
+		if err != nil {
+			return nil, err
+		}
+		if recipient.WrappedKey, err = sealWithAEAD(aead, dataKey, recipient.EncryptedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newSubkeyAEAD(dataKey, nil, cipherSuiteAES128GCMPayload)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.Ciphertext, err = sealWithAEAD(aead, message, nil); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// DecryptMulti decrypts a message encrypted with EncryptMulti. It tries each
+// recipient in turn, skipping those that are malformed or cannot be
+// decrypted (e.g., because the key store has no key for them, their
+// hierarchy is unknown, their epoch of public parameters was retired, or
+// their decryption was not admitted), and uses the first one whose wrapped
+// data key can be decrypted. If there is none, it returns the first error
+// other than ErrKeyNotFound that a recipient failed with, or else
+// ErrKeyNotFound. As with Decrypt, the message's integrity should be
+// verified before calling this function.
+func (state *ClientState) DecryptMulti(ctx context.Context, envelope *MultiEnvelope) ([]byte, error) {
+	var failure error
+	for i := range envelope.Recipients {
+		recipient := &envelope.Recipients[i]
+		if len(recipient.EncryptedKey) != EncryptedKeySize || state.checkPattern(recipient.Pattern) != nil {
+			continue
+		}
+
+		key, err := state.decryptionKey(ctx, recipient.Hierarchy, recipient.Pattern, cipherSuiteAES128CTR, recipient.EncryptedKey)
+		if err != nil {
+			/*
+			 * Any recipient may have been added by someone without a key for
+			 * ours, so its failure must not stop us from trying the rest,
+			 * unless we were cancelled.
+			 */
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if failure == nil && !errors.Is(err, ErrKeyNotFound) {
+				failure = err
+			}
+			continue
+		}
+
+		var aead cipher.AEAD
+		aead, err = newSubkeyAEAD(key[:], nil, cipherSuiteAES128GCMWrap)
+		zeroBytes(key[:])
+		if err != nil {
+			return nil, err
+		}
+		var dataKey []byte
+		if dataKey, err = openWithAEAD(aead, recipient.WrappedKey, recipient.EncryptedKey); err != nil || len(dataKey) != AESKeySize {
+			/*
+			 * The recipient may have been forged with the wrong pattern for
+			 * its EncryptedKey, in which case the decryption we just cached
+			 * is wrong. Evict it, so that it can't be used for a genuine
+			 * recipient with the same EncryptedKey.
+			 */
+			state.cache.Evict(state.loader, CacheKindDecryption, decryptionCacheKey(recipient.Hierarchy, recipient.EncryptedKey))
+			continue
+		}
+
+		aead, err = newSubkeyAEAD(dataKey, nil, cipherSuiteAES128GCMPayload)
+		zeroBytes(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		var message []byte
+		if message, err = openWithAEAD(aead, envelope.Ciphertext, nil); err != nil {
+			return nil, errors.New("multi-hierarchy envelope failed authentication")
+		}
+		return message, nil
+	}
+
+	if failure != nil {
+		return nil, failure
+	}
+	return nil, ErrKeyNotFound
+}
+
+// Marshal encodes a MultiEnvelope into a byte slice.
+func (e *MultiEnvelope) Marshal() []byte {
+	buf := newMessageBuffer(1024+len(e.Ciphertext), MarshalledTypeMultiEnvelope)
+	buf = marshalAppendLength(len(e.Recipients), buf)
+	for i := range e.Recipients {
+		recipient := &e.Recipients[i]
+		buf = marshalAppendWithLength(newMarshallableBytes(recipient.Hierarchy), buf)
+		buf = marshalAppendWithLength(&recipient.Pattern, buf)
+		buf = marshalAppendWithLength(newMarshallableBytes(recipient.EncryptedKey), buf)
+		buf = marshalAppendWithLength(newMarshallableBytes(recipient.WrappedKey), buf)
+	}
+	buf = marshalAppendWithLength(newMarshallableBytes(e.Ciphertext), buf)
+	return buf
+}
+
+// Unmarshal decodes a MultiEnvelope from a byte slice encoded with Marshal().
+func (e *MultiEnvelope) Unmarshal(marshalled []byte) bool {
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeMultiEnvelope); buf == nil {
+		return false
+	}
+
+	var length int
+	if length, buf = unmarshalPrefixLength(buf); buf == nil || length > len(buf) {
+		return false
+	}
+
+	e.Recipients = make([]MultiEnvelopeRecipient, length)
+	for i := range e.Recipients {
+		recipient := &e.Recipients[i]
+
+		var hierarchy marshallableBytes
+		if buf, _ = unmarshalPrefixWithLength(&hierarchy, buf); buf == nil {
+			return false
+		}
+		recipient.Hierarchy = hierarchy.b
+
+		if buf, _ = unmarshalPrefixWithLength(&recipient.Pattern, buf); buf == nil {
+			return false
+		}
+
+		var encryptedKey marshallableBytes
+		if buf, _ = unmarshalPrefixWithLength(&encryptedKey, buf); buf == nil {
+			return false
+		}
+		recipient.EncryptedKey = encryptedKey.b
+
+		var wrappedKey marshallableBytes
+		if buf, _ = unmarshalPrefixWithLength(&wrappedKey, buf); buf == nil {
+			return false
+		}
+		recipient.WrappedKey = wrappedKey.b
+	}
+
+	var ciphertext marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&ciphertext, buf); buf == nil {
+		return false
+	}
+	e.Ciphertext = ciphertext.b
+
+	return len(buf) == 0
+}
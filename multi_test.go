@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+type testMultiHierarchyStore struct {
+	hierarchies map[string]*TestKeyStore
+	keys        map[string]bool
+}
+
+// errUnknownTestHierarchy is returned by testMultiHierarchyStore for
+// hierarchies that it does not know.
+var errUnknownTestHierarchy = errors.New("unknown hierarchy")
+
+func (tmhs *testMultiHierarchyStore) ParamsForHierarchy(ctx context.Context, hierarchy []byte) (*wkdibe.Params, error) {
+	store, ok := tmhs.hierarchies[string(hierarchy)]
+	if !ok {
+		return nil, errUnknownTestHierarchy
+	}
+	return store.params, nil
+}
+
+func (tmhs *testMultiHierarchyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	store, ok := tmhs.hierarchies[string(hierarchy)]
+	if !ok {
+		return nil, nil, errUnknownTestHierarchy
+	}
+	if !tmhs.keys[string(hierarchy)] {
+		return nil, nil, nil
+	}
+	return store.KeyForPattern(ctx, hierarchy, pattern)
+}
+
+func TestMultiEnvelope(t *testing.T) {
+	var err error
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	_, owner := NewTestKeyStore()
+	_, tenant := NewTestKeyStore()
+	hierarchies := map[string]*TestKeyStore{"owner": owner, "tenant": tenant}
+	now := time.Now()
+	ctx := context.Background()
+
+	publisherStore := &testMultiHierarchyStore{hierarchies: hierarchies}
+	publisher := NewClientState(publisherStore, publisherStore, encoder, 1<<20)
+
+	targets := []MultiEnvelopeTarget{
+		{Hierarchy: []byte("owner"), URI: "building/floor1/temp"},
+		{Hierarchy: []byte("tenant"), URI: "suite100/temp"},
+	}
+	var envelope *MultiEnvelope
+	if envelope, err = publisher.EncryptMulti(ctx, targets, now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Marshal and unmarshal the envelope, to check that as well. */
+	marshalled := envelope.Marshal()
+	envelope = new(MultiEnvelope)
+	if !envelope.Unmarshal(marshalled) {
+		t.Fatal("Could not unmarshal multi-hierarchy envelope")
+	}
+	if new(MultiEnvelope).Unmarshal(append(marshalled, 0)) {
+		t.Fatal("Unmarshalled a multi-hierarchy envelope with trailing bytes")
+	}
+
+	for _, hierarchy := range []string{"owner", "tenant"} {
+		subscriberStore := &testMultiHierarchyStore{hierarchies: hierarchies, keys: map[string]bool{hierarchy: true}}
+		subscriber := NewClientState(subscriberStore, subscriberStore, encoder, 1<<20)
+		var decrypted []byte
+		if decrypted, err = subscriber.DecryptMulti(ctx, envelope); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte(quote1)) {
+			t.Fatalf("Original and decrypted messages differ for hierarchy %s", hierarchy)
+		}
+	}
+
+	outsiderStore := &testMultiHierarchyStore{hierarchies: hierarchies}
+	outsider := NewClientState(outsiderStore, outsiderStore, encoder, 1<<20)
+	if _, err = outsider.DecryptMulti(ctx, envelope); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestMultiEnvelopeUnknownHierarchy(t *testing.T) {
+	var err error
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	_, foreign := NewTestKeyStore()
+	_, owner := NewTestKeyStore()
+	now := time.Now()
+	ctx := context.Background()
+
+	publisherStore := &testMultiHierarchyStore{hierarchies: map[string]*TestKeyStore{"foreign": foreign, "owner": owner}}
+	publisher := NewClientState(publisherStore, publisherStore, encoder, 1<<20)
+
+	targets := []MultiEnvelopeTarget{
+		{Hierarchy: []byte("foreign"), URI: "a/b/c"},
+		{Hierarchy: []byte("owner"), URI: "building/floor1/temp"},
+	}
+	var envelope *MultiEnvelope
+	if envelope, err = publisher.EncryptMulti(ctx, targets, now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+	 * The subscriber's info reader fails for the first recipient's
+	 * hierarchy, which must not stop it from using the second recipient.
+	 */
+	subscriberStore := &testMultiHierarchyStore{
+		hierarchies: map[string]*TestKeyStore{"owner": owner},
+		keys:        map[string]bool{"owner": true},
+	}
+	subscriber := NewClientState(subscriberStore, subscriberStore, encoder, 1<<20)
+	var decrypted []byte
+	if decrypted, err = subscriber.DecryptMulti(ctx, envelope); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+
+	/* Without a key for any recipient, the info reader's error is returned. */
+	outsiderStore := &testMultiHierarchyStore{hierarchies: map[string]*TestKeyStore{"owner": owner}}
+	outsider := NewClientState(outsiderStore, outsiderStore, encoder, 1<<20)
+	if _, err = outsider.DecryptMulti(ctx, envelope); !errors.Is(err, errUnknownTestHierarchy) {
+		t.Fatalf("Expected the info reader's error, got %v", err)
+	}
+}
+
+func TestMultiEnvelopeForgedRecipient(t *testing.T) {
+	var err error
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	_, owner := NewTestKeyStore()
+	hierarchies := map[string]*TestKeyStore{"owner": owner}
+	now := time.Now()
+	ctx := context.Background()
+
+	store := &testMultiHierarchyStore{hierarchies: hierarchies, keys: map[string]bool{"owner": true}}
+	publisher := NewClientState(store, store, encoder, 1<<20)
+	subscriber := NewClientState(store, store, encoder, 1<<20)
+
+	targets := []MultiEnvelopeTarget{{Hierarchy: []byte("owner"), URI: "building/floor1/temp"}}
+	var envelope *MultiEnvelope
+	if envelope, err = publisher.EncryptMulti(ctx, targets, now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	genuine := envelope.Recipients[0]
+
+	/* A recipient whose pattern has the wrong length is skipped. */
+	forged := *envelope
+	forged.Recipients = []MultiEnvelopeRecipient{genuine}
+	forged.Recipients[0].Pattern = append(Pattern{[]byte("extra")}, genuine.Pattern...)
+	if _, err = subscriber.DecryptMulti(ctx, &forged); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	/*
+	 * A recipient with the genuine EncryptedKey, but the pattern for another
+	 * URI, fails to unwrap the data key, and must not leave the wrong
+	 * decryption of the EncryptedKey in the cache.
+	 */
+	var other Pattern
+	if _, other, err = subscriber.encodePattern("building/floor2/temp", now); err != nil {
+		t.Fatal(err)
+	}
+	forged.Recipients[0].Pattern = other
+	if _, err = subscriber.DecryptMulti(ctx, &forged); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	var decrypted []byte
+	if decrypted, err = subscriber.DecryptMulti(ctx, envelope); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
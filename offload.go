@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// cipherSuiteX25519AES128GCMOffload identifies the key used to seal symmetric
+// keys to devices in responses from an OffloadServer.
+const cipherSuiteX25519AES128GCMOffload = "X25519-AES-128-GCM-OFFLOAD"
+
+// OffloadRequest asks an OffloadServer to decrypt the WKD-IBE ciphertext at
+// the beginning of a JEDI ciphertext on behalf of a device. It contains only
+// the WKD-IBE ciphertext, not the encrypted message, so the server never has
+// access to the message's plaintext.
+type OffloadRequest struct {
+	DeviceID     string
+	Hierarchy    []byte
+	URI          string
+	Timestamp    time.Time
+	EncryptedKey []byte
+}
+
+// OffloadResponse contains the symmetric key decrypted by an OffloadServer,
+// sealed to the device's X25519 public key. EphemeralKey is the server's
+// ephemeral X25519 public key, and SealedKey is the AES-GCM encryption of
+// the symmetric key under a key derived from the X25519 shared secret.
+type OffloadResponse struct {
+	EphemeralKey []byte
+	SealedKey    []byte
+}
+
+// OffloadDeviceReader represents a read-only interface to the set of devices
+// that an OffloadServer serves. Like KeyStoreReader, it is meant to be
+// implemented by the calling application.
+type OffloadDeviceReader interface {
+	// DevicePublicKey returns the X25519 public key of the device with the
+	// provided ID, or nil if the device is not served.
+	DevicePublicKey(ctx context.Context, deviceID string) (*ecdh.PublicKey, error)
+
+	// Authorized returns true if the device with the provided ID may decrypt
+	// messages with the provided pattern (which encodes a URI and time) in
+	// the provided hierarchy. The OffloadServer holds the delegations for
+	// all of its devices, so this is what limits each device to the part of
+	// the hierarchy that it was granted.
+	Authorized(ctx context.Context, deviceID string, hierarchy []byte, pattern Pattern) (bool, error)
+}
+
+// OffloadServer decrypts WKD-IBE ciphertexts on behalf of devices that cannot
+// perform pairing operations, such as browsers and microcontrollers. It is
+// trusted with the delegations for those devices, which are read from its
+// ClientState's key store.
+type OffloadServer struct {
+	state   *ClientState
+	devices OffloadDeviceReader
+}
+
+// NewOffloadServer creates a new OffloadServer that decrypts WKD-IBE
+// ciphertexts using the provided ClientState, for the devices provided by the
+// OffloadDeviceReader.
+func NewOffloadServer(state *ClientState, devices OffloadDeviceReader) *OffloadServer {
+	return &OffloadServer{
+		state:   state,
+		devices: devices,
+	}
+}
+
+// offloadSealingAEAD derives the AEAD used to seal a symmetric key to a
+// device from the X25519 shared secret and both public keys.
+func offloadSealingAEAD(shared []byte, ephemeral []byte, device []byte) (cipher.AEAD, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(device))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, device...)
+	return newSubkeyAEAD(shared, salt, cipherSuiteX25519AES128GCMOffload)
+}
+
+// Handle decrypts the WKD-IBE ciphertext in the request, and returns the
+// symmetric key sealed to the requesting device's public key. The request is
+// refused unless the OffloadDeviceReader authorizes the device for the
+// request's hierarchy, URI, and time. The decryption uses the server's
+// ClientState, so it is cached as with Decrypt, except that the cached
+// decryption is keyed by the hierarchy and pattern as well as the ciphertext.
+// This keeps a device that sends a ciphertext with the wrong URI or time from
+// caching an incorrect key for other devices that send it correctly. The
+// request's encrypted key must have the format of the ClientState's messages
+// (see WithUnversionedMessages).
+func (server *OffloadServer) Handle(ctx context.Context, request *OffloadRequest) (*OffloadResponse, error) {
+	if len(request.EncryptedKey) != server.state.messageKeySize() {
+		return nil, errors.New("encryptedKey has invalid size")
+	}
+	encryptedKey := server.state.expandMessageKey(request.EncryptedKey)
+
+	devicePublic, err := server.devices.DevicePublicKey(ctx, request.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	if devicePublic == nil {
+		return nil, errors.New("unknown device")
+	}
+
+	_, pattern, err := server.state.encodePattern(request.URI, request.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized, err := server.devices.Authorized(ctx, request.DeviceID, request.Hierarchy, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if !authorized {
+		return nil, errors.New("device is not authorized for this URI and time")
+	}
+
+	cacheKey := patternDecryptionCacheKey(request.Hierarchy, pattern, encryptedKey)
+	entry, ciphertext, err := server.state.lookupDecryption(ctx, cacheKey, request.Hierarchy, pattern, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := server.state.decryptionForEntry(ctx, cacheKey, entry, request.Hierarchy, pattern, cipherSuiteAES128CTR, encryptedKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(key[:])
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(devicePublic)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &OffloadResponse{
+		EphemeralKey: ephemeral.PublicKey().Bytes(),
+	}
+	aead, err := offloadSealingAEAD(shared, response.EphemeralKey, devicePublic.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if response.SealedKey, err = sealWithAEAD(aead, key[:], request.EncryptedKey); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// OffloadClient is used by a device to decrypt JEDI ciphertexts with the help
+// of an OffloadServer. It performs only X25519, HKDF, and AES operations.
+type OffloadClient struct {
+	deviceID string
+	private  *ecdh.PrivateKey
+	keySize  int
+}
+
+// NewOffloadClient creates a new OffloadClient for the device with the
+// provided ID and X25519 private key.
+func NewOffloadClient(deviceID string, private *ecdh.PrivateKey) *OffloadClient {
+	return &OffloadClient{
+		deviceID: deviceID,
+		private:  private,
+		keySize:  EncryptedKeySize,
+	}
+}
+
+// NewUnversionedOffloadClient is like NewOffloadClient, but creates an
+// OffloadClient for messages that omit the epoch of public parameters, as
+// those of a ClientState configured with WithUnversionedMessages do.
+func NewUnversionedOffloadClient(deviceID string, private *ecdh.PrivateKey) *OffloadClient {
+	client := NewOffloadClient(deviceID, private)
+	client.keySize = EncryptedKeySize - ParamEpochLength
+	return client
+}
+
+// Request returns the request to send to the OffloadServer to decrypt a JEDI
+// ciphertext, which must then be passed to Decrypt along with the server's
+// response.
+func (client *OffloadClient) Request(hierarchy []byte, uri string, timestamp time.Time, encrypted []byte) (*OffloadRequest, error) {
+	if len(encrypted) < client.keySize+aes.BlockSize {
+		return nil, errors.New("Encrypted blob is too short to be valid")
+	}
+	return &OffloadRequest{
+		DeviceID:     client.deviceID,
+		Hierarchy:    hierarchy,
+		URI:          uri,
+		Timestamp:    timestamp,
+		EncryptedKey: encrypted[:client.keySize],
+	}, nil
+}
+
+// Decrypt unseals the symmetric key in the server's response, and uses it to
+// decrypt the JEDI ciphertext.
+func (client *OffloadClient) Decrypt(response *OffloadResponse, encrypted []byte) ([]byte, error) {
+	if len(encrypted) < client.keySize+aes.BlockSize {
+		return nil, errors.New("Encrypted blob is too short to be valid")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(response.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := client.private.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := offloadSealingAEAD(shared, response.EphemeralKey, client.private.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := openWithAEAD(aead, response.SealedKey, encrypted[:client.keySize])
+	if err != nil || len(key) != AESKeySize {
+		return nil, errors.New("offload response failed authentication")
+	}
+	defer zeroBytes(key)
+
+	encryptedMessage := encrypted[client.keySize:]
+	decrypted := make([]byte, len(encryptedMessage)-aes.BlockSize)
+	if err = aesCTRDecryptInMem(decrypted, encryptedMessage, key); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// Marshal encodes an OffloadRequest into a byte slice.
+func (r *OffloadRequest) Marshal() []byte {
+	buf := newMessageBuffer(64+len(r.DeviceID)+len(r.Hierarchy)+len(r.URI)+len(r.EncryptedKey), MarshalledTypeOffloadRequest)
+	buf = marshalAppendWithLength(newMarshallableBytes([]byte(r.DeviceID)), buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(r.Hierarchy), buf)
+	buf = marshalAppendWithLength(newMarshallableBytes([]byte(r.URI)), buf)
+
+	var timestamp [8]byte
+	binary.LittleEndian.PutUint64(timestamp[:], uint64(r.Timestamp.UnixNano()))
+	buf = append(buf, timestamp[:]...)
+
+	buf = marshalAppendWithLength(newMarshallableBytes(r.EncryptedKey), buf)
+	return buf
+}
+
+// Unmarshal decodes an OffloadRequest from a byte slice encoded with
+// Marshal().
+func (r *OffloadRequest) Unmarshal(marshalled []byte) bool {
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeOffloadRequest); buf == nil {
+		return false
+	}
+
+	var deviceID marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&deviceID, buf); buf == nil {
+		return false
+	}
+	r.DeviceID = string(deviceID.b)
+
+	var hierarchy marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&hierarchy, buf); buf == nil {
+		return false
+	}
+	r.Hierarchy = hierarchy.b
+
+	var uri marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&uri, buf); buf == nil || len(buf) < 8 {
+		return false
+	}
+	r.URI = string(uri.b)
+
+	r.Timestamp = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[:8])))
+	buf = buf[8:]
+
+	var encryptedKey marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&encryptedKey, buf); buf == nil {
+		return false
+	}
+	r.EncryptedKey = encryptedKey.b
+
+	return len(buf) == 0
+}
+
+// Marshal encodes an OffloadResponse into a byte slice.
+func (r *OffloadResponse) Marshal() []byte {
+	buf := newMessageBuffer(16+len(r.EphemeralKey)+len(r.SealedKey), MarshalledTypeOffloadResponse)
+	buf = marshalAppendWithLength(newMarshallableBytes(r.EphemeralKey), buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(r.SealedKey), buf)
+	return buf
+}
+
+// Unmarshal decodes an OffloadResponse from a byte slice encoded with
+// Marshal().
+func (r *OffloadResponse) Unmarshal(marshalled []byte) bool {
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeOffloadResponse); buf == nil {
+		return false
+	}
+
+	var ephemeralKey marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&ephemeralKey, buf); buf == nil {
+		return false
+	}
+	r.EphemeralKey = ephemeralKey.b
+
+	var sealedKey marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&sealedKey, buf); buf == nil {
+		return false
+	}
+	r.SealedKey = sealedKey.b
+
+	return len(buf) == 0
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+type testOffloadDevices struct {
+	devices map[string]*ecdh.PublicKey
+	grants  map[string]Pattern
+}
+
+func (tod *testOffloadDevices) DevicePublicKey(ctx context.Context, deviceID string) (*ecdh.PublicKey, error) {
+	return tod.devices[deviceID], nil
+}
+
+func (tod *testOffloadDevices) Authorized(ctx context.Context, deviceID string, hierarchy []byte, pattern Pattern) (bool, error) {
+	grant, ok := tod.grants[deviceID]
+	if !ok {
+		return true, nil
+	}
+	return bytes.Equal(hierarchy, TestHierarchy) && grant.Matches(pattern), nil
+}
+
+func TestOffload(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	var private *ecdh.PrivateKey
+	if private, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	devices := &testOffloadDevices{devices: map[string]*ecdh.PublicKey{"device1": private.PublicKey()}}
+	server := NewOffloadServer(NewClientState(info, store, encoder, 1<<20), devices)
+	client := NewOffloadClient("device1", private)
+
+	var encrypted []byte
+	if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var request *OffloadRequest
+	if request, err = client.Request(TestHierarchy, "a/b/c", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Marshal and unmarshal the request and response, as a transport would. */
+	unmarshalledRequest := new(OffloadRequest)
+	if !unmarshalledRequest.Unmarshal(request.Marshal()) {
+		t.Fatal("Could not unmarshal offload request")
+	}
+	if new(OffloadRequest).Unmarshal(append(request.Marshal(), 0)) {
+		t.Fatal("Unmarshalled an offload request with trailing bytes")
+	}
+	var response *OffloadResponse
+	if response, err = server.Handle(ctx, unmarshalledRequest); err != nil {
+		t.Fatal(err)
+	}
+	unmarshalledResponse := new(OffloadResponse)
+	if !unmarshalledResponse.Unmarshal(response.Marshal()) {
+		t.Fatal("Could not unmarshal offload response")
+	}
+	if new(OffloadResponse).Unmarshal(append(response.Marshal(), 0)) {
+		t.Fatal("Unmarshalled an offload response with trailing bytes")
+	}
+
+	var decrypted []byte
+	if decrypted, err = client.Decrypt(unmarshalledResponse, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+
+	/* Another device cannot unseal the response. */
+	var otherPrivate *ecdh.PrivateKey
+	if otherPrivate, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewOffloadClient("device1", otherPrivate).Decrypt(response, encrypted); err == nil {
+		t.Fatal("Another device unsealed the offload response")
+	}
+
+	/* Unknown devices are rejected. */
+	request.DeviceID = "device2"
+	if _, err = server.Handle(ctx, request); err == nil {
+		t.Fatal("No error for an unknown device")
+	}
+}
+
+func TestOffloadUnauthorized(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	var private *ecdh.PrivateKey
+	if private, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	/* The device is granted a/b/* for the current time only. */
+	uriPath, err := ParseURI("a/b/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timePath, err := ParseTime(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant := encoder.Encode(uriPath, timePath, PatternTypeDecryption)
+	devices := &testOffloadDevices{
+		devices: map[string]*ecdh.PublicKey{"device1": private.PublicKey()},
+		grants:  map[string]Pattern{"device1": grant},
+	}
+	server := NewOffloadServer(NewClientState(info, store, encoder, 1<<20), devices)
+	client := NewOffloadClient("device1", private)
+
+	cases := []struct {
+		uri        string
+		timestamp  time.Time
+		authorized bool
+	}{
+		{"a/b/c", now, true},
+		{"a/d", now, false},
+		{"a/b/c", now.Add(48 * time.Hour), false},
+	}
+	for _, c := range cases {
+		var encrypted []byte
+		if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, c.uri, c.timestamp, []byte(quote1)); err != nil {
+			t.Fatal(err)
+		}
+		var request *OffloadRequest
+		if request, err = client.Request(TestHierarchy, c.uri, c.timestamp, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = server.Handle(ctx, request); (err == nil) != c.authorized {
+			t.Fatalf("Unexpected result for %s at %v: %v", c.uri, c.timestamp, err)
+		}
+	}
+}
+
+func TestOffloadWrongPattern(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	publisher := NewClientState(info, store, encoder, 1<<20)
+	now := time.Now()
+	ctx := context.Background()
+
+	var private1, private2 *ecdh.PrivateKey
+	if private1, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if private2, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	devices := &testOffloadDevices{devices: map[string]*ecdh.PublicKey{"device1": private1.PublicKey(), "device2": private2.PublicKey()}}
+	server := NewOffloadServer(NewClientState(info, store, encoder, 1<<20), devices)
+
+	var encrypted []byte
+	if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The first device sends the ciphertext with the wrong URI. */
+	var request *OffloadRequest
+	if request, err = NewOffloadClient("device1", private1).Request(TestHierarchy, "a/b/d", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Handle(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The second device must still get the right key. */
+	client := NewOffloadClient("device2", private2)
+	if request, err = client.Request(TestHierarchy, "a/b/c", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	var response *OffloadResponse
+	if response, err = server.Handle(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	var decrypted []byte
+	if decrypted, err = client.Decrypt(response, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
+
+func TestOffloadUnversioned(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	publisher := NewClientState(info, store, encoder, 1<<20, WithLegacyKeyDerivation(), WithUnversionedMessages())
+	now := time.Now()
+	ctx := context.Background()
+
+	var private *ecdh.PrivateKey
+	if private, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	devices := &testOffloadDevices{devices: map[string]*ecdh.PublicKey{"device1": private.PublicKey()}}
+	server := NewOffloadServer(NewClientState(info, store, encoder, 1<<20, WithLegacyKeyDerivation(), WithUnversionedMessages()), devices)
+	client := NewUnversionedOffloadClient("device1", private)
+
+	var encrypted []byte
+	if encrypted, err = publisher.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var request *OffloadRequest
+	if request, err = client.Request(TestHierarchy, "a/b/c", now, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.EncryptedKey) != EncryptedKeySize-ParamEpochLength {
+		t.Fatalf("Unversioned request has a %d-byte encrypted key", len(request.EncryptedKey))
+	}
+	var response *OffloadResponse
+	if response, err = server.Handle(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted []byte
+	if decrypted, err = client.Decrypt(response, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte(quote1)) {
+		t.Fatal("Original and decrypted messages differ")
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import "time"
+
+// ClientOption configures optional behavior of a ClientState. ClientOptions
+// are passed to NewClientState.
+type ClientOption func(state *ClientState)
+
+// WithTrustedCiphertexts configures a ClientState to skip checking that the
+// group elements in WKD-IBE ciphertexts are valid (i.e., on the curve and in
+// the correct subgroup) before decrypting them. By default, these checks are
+// performed, because ciphertexts typically arrive over the network from
+// untrusted parties. This option should only be used for performance-critical
+// paths where all ciphertexts come from a trusted source.
+func WithTrustedCiphertexts() ClientOption {
+	return func(state *ClientState) {
+		state.trustedCiphertexts = true
+	}
+}
+
+// WithLegacyKeyDerivation configures a ClientState to derive the AES key for
+// each message by hashing the WKD-IBE plaintext directly, as JEDI did before
+// keys were bound to the hierarchy, pattern, and cipher suite. This is needed
+// to decrypt ciphertexts produced by older versions of this library or by
+// other JEDI implementations, and to produce ciphertexts that they can
+// decrypt, along with WithUnversionedMessages, since those messages also
+// lack the epoch of public parameters. It should not be used otherwise.
+func WithLegacyKeyDerivation() ClientOption {
+	return func(state *ClientState) {
+		state.legacyKeyDerivation = true
+	}
+}
+
+// WithUnversionedMessages configures a ClientState to omit the epoch of
+// public parameters from the encrypted key at the beginning of each message
+// (see EncryptedKeySize), as older versions of this library and other JEDI
+// implementations do. Since the messages do not record their epoch, the
+// ClientState encrypts and decrypts them under epoch 0 (see
+// VersionedPublicInfoReader). The provisioning bundles that it produces, and
+// the OffloadServer that uses it, follow the same format; devices decrypting
+// its messages with the help of that server should use an OffloadClient
+// created with NewUnversionedOffloadClient.
+func WithUnversionedMessages() ClientOption {
+	return func(state *ClientState) {
+		state.unversionedMessages = true
+	}
+}
+
+// WithObserver configures a ClientState to report the behavior of its cache,
+// and the cryptographic operations that it performs, to the provided
+// Observer. A Metrics instance can be used to collect and expose these
+// events.
+func WithObserver(observer Observer) ClientOption {
+	return func(state *ClientState) {
+		state.observer = observer
+	}
+}
+
+// WithCache configures a ClientState to store the objects that accelerate
+// its crypto operations in the provided Cache, instead of creating its own
+// LRU cache. This allows a Cache with custom policies or budgets to be used,
+// or a single Cache to be shared by multiple ClientStates.
+func WithCache(cache Cache) ClientOption {
+	return func(state *ClientState) {
+		state.cache = cache
+	}
+}
+
+// WithEncryptionExpiry configures a ClientState to evict each cached
+// encryption entry once the hour of the TimePath that it was last used for
+// has passed, plus the provided grace period. By default, encryption entries
+// are only evicted when the cache is full. The grace period allows messages
+// that are slightly delayed to be encrypted without recomputing the entry.
+func WithEncryptionExpiry(grace time.Duration) ClientOption {
+	return func(state *ClientState) {
+		state.encryptionExpiry = true
+		state.encryptionGrace = grace
+	}
+}
+
+// WithDecryptionTTL configures a ClientState to evict each cached decryption
+// of a symmetric key once the provided time has elapsed since it was
+// decrypted. By default, decryption entries are only evicted when the cache
+// is full.
+func WithDecryptionTTL(ttl time.Duration) ClientOption {
+	return func(state *ClientState) {
+		state.decryptionTTL = ttl
+	}
+}
+
+// WithLockedMemory configures a ClientState to store the symmetric keys in its
+// cache, and the WKD-IBE plaintexts that they are derived from, in a pool of
+// memory that is locked into RAM when the ClientState is created, so that
+// they are never written to swap. The pool has room for the provided number
+// of keys. If the pool is full, or its memory could not be locked (for
+// example, because the process's limit on locked memory is too low, or
+// because the platform is not Linux), keys are stored in ordinary memory
+// instead, and each such key is reported to the Observer. Qualified WKD-IBE
+// secret keys are allocated by the pairing library, so they are wiped when
+// they are evicted, but are not locked. The pool is wiped and unlocked when
+// the ClientState is closed.
+func WithLockedMemory(keys int) ClientOption {
+	return func(state *ClientState) {
+		state.lockedKeys = keys
+	}
+}
+
+// WithTenantBudgets configures a ClientState that serves the hierarchies of
+// several tenants to give each tenant its own partition of the cache, with
+// the memory budget in the provided configuration. Objects are evicted only
+// to make room for other objects of the same tenant, so one tenant's traffic
+// cannot evict the objects that accelerate another tenant's messages. The
+// budgets replace any Cache provided with WithCache. The capacity passed to
+// NewClientState bounds the total budget of the partitions that exist at
+// once; to make room for a new tenant's partition, empty partitions, and
+// then those of the least recently active tenants, are reclaimed along with
+// their objects. The usage of each tenant's budget is reported by
+// TenantUsage.
+func WithTenantBudgets(config TenantConfig) ClientOption {
+	return func(state *ClientState) {
+		state.tenants = &config
+	}
+}
+
+// WithAdmissionControl configures a ClientState to rate-limit cold
+// decryptions, i.e., decryptions of ciphertexts that are not in its cache, as
+// specified in the provided configuration. A decryption that would exceed the
+// rate fails with ErrDecryptionRateLimited, without creating a cache entry,
+// so that a flood of unique ciphertexts from a compromised party costs
+// neither key store lookups and pairings beyond the rate, nor evictions of
+// useful entries. Decryptions of cached ciphertexts are not limited.
+// Regardless of this option, malformed ciphertexts are rejected before a
+// cache entry is created for them, and entries whose decryption fails are
+// evicted.
+func WithAdmissionControl(config AdmissionConfig) ClientOption {
+	return func(state *ClientState) {
+		state.admission = newAdmissionControl(config)
+	}
+}
+
+// WithEncryptionSlots configures a ClientState to keep, for each URI, the
+// symmetric keys and WKD-IBE ciphertexts for up to the provided number of the
+// patterns (i.e., hours) most recently used to encrypt messages for that URI.
+// By default, only the most recent one is kept, so a publisher that
+// interleaves messages for different hours on the same URI (for example,
+// live data and backfilled data from earlier hours) recomputes the encryption
+// each time it switches between them. Each encryption cache entry is
+// accounted for with room for all of its slots, so fewer URIs fit in the
+// cache as the number grows. Numbers less than 1 are treated as 1.
+func WithEncryptionSlots(slots int) ClientOption {
+	return func(state *ClientState) {
+		if slots < 1 {
+			slots = 1
+		}
+		state.encryptionSlots = slots
+	}
+}
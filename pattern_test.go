@@ -302,4 +302,10 @@ func TestPatternMarshal(t *testing.T) {
 	if !pattern2.Equals(unmarshalled2) {
 		t.Fatal("pattern2 is different after unmarshal")
 	}
+
+	/* A huge length must be rejected before it is allocated. */
+	putLength(marshalled1[1:], 0xFFFFFFFF)
+	if unmarshalled1.Unmarshal(marshalled1) {
+		t.Fatal("Unmarshalled a pattern with a huge length")
+	}
 }
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/cryptutils"
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+// ProvisioningBundle contains precomputed symmetric keys and WKD-IBE
+// ciphertexts for a single URI, one for each hour in a time window. It allows
+// a constrained device that cannot perform pairing operations to encrypt
+// messages using only AES: for each message, the device picks the slot for
+// the current hour, encrypts the message with that slot's key, and prepends
+// the slot's WKD-IBE ciphertext. The result is an ordinary JEDI ciphertext
+// that subscribers decrypt with Decrypt.
+//
+// When marshalled, a bundle has the following compact, fixed-size layout,
+// with all integers in little-endian byte order:
+//
+//	1 byte                  MarshalledTypeProvisioningBundle
+//	4 bytes                 first hour, in hours since the Unix epoch
+//	2 bytes                 number of slots
+//	for each slot:
+//	  AESKeySize bytes        symmetric key
+//	  EncryptedKeySize bytes  epoch and WKD-IBE ciphertext of the key
+//
+// The slot for a time is at index (hours since the Unix epoch - first hour).
+// Bundles produced by a ClientState configured with WithUnversionedMessages
+// omit the epoch from each slot, as from the messages encrypted with them;
+// the size of the bundle tells which format it uses.
+type ProvisioningBundle struct {
+	FirstHour uint32
+	Slots     []ProvisioningSlot
+}
+
+// ProvisioningSlot contains the symmetric key and WKD-IBE ciphertext for one
+// hour in a ProvisioningBundle.
+type ProvisioningSlot struct {
+	Key          [AESKeySize]byte
+	EncryptedKey []byte
+}
+
+// MaxProvisioningSlots is the maximum number of hours that a single
+// ProvisioningBundle can cover.
+const MaxProvisioningSlots = 0xFFFF
+
+const provisioningBundleHeaderSize = 1 + 4 + 2
+
+// provisioningHour returns the number of hours since the Unix epoch.
+func provisioningHour(timestamp time.Time) uint32 {
+	return uint32(timestamp.Unix() / 3600)
+}
+
+// Provision precomputes a ProvisioningBundle for a device that publishes on
+// a URI, with one slot for each hour that overlaps with the time window
+// [start, end). The attribute list is prepared once, and adjusted for each
+// subsequent hour. The encrypted keys in the bundle have the format of the
+// ClientState's messages (see WithUnversionedMessages). This function does
+// not use or modify the ClientState's encryption cache.
+func (state *ClientState) Provision(ctx context.Context, hierarchy []byte, uri string, start time.Time, end time.Time) (*ProvisioningBundle, error) {
+	firstHour := provisioningHour(start)
+	lastHour := provisioningHour(end.Add(-time.Nanosecond))
+	if !end.After(start) {
+		return nil, errors.New("provisioning window is empty")
+	}
+	if lastHour-firstHour >= MaxProvisioningSlots {
+		return nil, errors.New("provisioning window is too long")
+	}
+
+	uriPath, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	paramsInt, err := state.cacheGet(ctx, hierarchyCacheKey(hierarchy))
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := state.encryptionParamEpoch(paramsInt.(*hierarchyCacheEntry))
+	if err != nil {
+		return nil, err
+	}
+	params := epoch.Params
+
+	bundle := &ProvisioningBundle{
+		FirstHour: firstHour,
+		Slots:     make([]ProvisioningSlot, 0, lastHour-firstHour+1),
+	}
+
+	var previous Pattern
+	var previousAttrs wkdibe.AttributeList
+	var precomputed *wkdibe.PreparedAttributeList
+	for hour := firstHour; hour <= lastHour; hour++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var timePath TimePath
+		if timePath, err = ParseTime(time.Unix(int64(hour)*3600, 0)); err != nil {
+			return nil, err
+		}
+		pattern := state.encoder.Encode(uriPath, timePath, PatternTypeDecryption)
+
+		var attrs wkdibe.AttributeList
+		if precomputed == nil {
+			attrs = pattern.ToAttrs()
+			start := time.Now()
+			precomputed = wkdibe.PrepareAttributeList(params, attrs)
+			state.observeOperation(OperationPrepare, start)
+		} else {
+			attrs, _ = pattern.ToAttrsWithReference(previous, previousAttrs)
+			start := time.Now()
+			wkdibe.AdjustPreparedAttributeList(precomputed, params, previousAttrs, attrs)
+			state.observeOperation(OperationAdjust, start)
+		}
+		previous, previousAttrs = pattern, attrs
+
+		var slot ProvisioningSlot
+		var secret [keyDerivationSecretSize]byte
+		_, encryptable := cryptutils.GenerateKey(secret[:])
+		zeroBytes(secret[:])
+		err = state.symmetricKey(slot.Key[:], encryptable, hierarchy, pattern, cipherSuiteAES128CTR)
+		if err != nil {
+			wipeEncryptable(encryptable)
+			return nil, err
+		}
+		start := time.Now()
+		encryptedKey := make([]byte, EncryptedKeySize)
+		marshalEncryptedKey(encryptedKey, epoch.Epoch, wkdibe.EncryptPrepared(encryptable, params, precomputed))
+		state.observeOperation(OperationEncrypt, start)
+		slot.EncryptedKey = encryptedKey[EncryptedKeySize-state.messageKeySize():]
+		wipeEncryptable(encryptable)
+		bundle.Slots = append(bundle.Slots, slot)
+	}
+
+	return bundle, nil
+}
+
+// Encrypt encrypts a message using the slot for the provided time, producing
+// an ordinary JEDI ciphertext. It uses only AES, and is the reference for the
+// encryption procedure to implement on constrained devices.
+func (bundle *ProvisioningBundle) Encrypt(timestamp time.Time, message []byte) ([]byte, error) {
+	hour := provisioningHour(timestamp)
+	if hour < bundle.FirstHour || hour-bundle.FirstHour >= uint32(len(bundle.Slots)) {
+		return nil, errors.New("provisioning bundle has no slot for the provided time")
+	}
+	slot := &bundle.Slots[hour-bundle.FirstHour]
+
+	keySize := len(slot.EncryptedKey)
+	encrypted := make([]byte, keySize+aes.BlockSize+len(message))
+	copy(encrypted[:keySize], slot.EncryptedKey)
+	if err := aesCTREncryptInMem(encrypted[keySize:], message, slot.Key[:]); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// Marshal encodes a ProvisioningBundle into a byte slice, using the layout
+// described in the documentation for ProvisioningBundle.
+func (bundle *ProvisioningBundle) Marshal() []byte {
+	slotSize := AESKeySize + EncryptedKeySize
+	if len(bundle.Slots) != 0 {
+		slotSize = AESKeySize + len(bundle.Slots[0].EncryptedKey)
+	}
+	buf := newMessageBuffer(provisioningBundleHeaderSize+len(bundle.Slots)*slotSize, MarshalledTypeProvisioningBundle)
+
+	var header [6]byte
+	binary.LittleEndian.PutUint32(header[:4], bundle.FirstHour)
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(bundle.Slots)))
+	buf = append(buf, header[:]...)
+
+	for _, slot := range bundle.Slots {
+		buf = append(buf, slot.Key[:]...)
+		buf = append(buf, slot.EncryptedKey...)
+	}
+	return buf
+}
+
+// Unmarshal decodes a ProvisioningBundle from a byte slice encoded with
+// Marshal().
+func (bundle *ProvisioningBundle) Unmarshal(marshalled []byte) bool {
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeProvisioningBundle); buf == nil || len(buf) < 6 {
+		return false
+	}
+
+	bundle.FirstHour = binary.LittleEndian.Uint32(buf[:4])
+	numSlots := int(binary.LittleEndian.Uint16(buf[4:6]))
+	buf = buf[6:]
+
+	slotSize := AESKeySize + EncryptedKeySize
+	if len(buf) != numSlots*slotSize {
+		/* The bundle may be for unversioned messages. */
+		slotSize -= ParamEpochLength
+		if len(buf) != numSlots*slotSize {
+			return false
+		}
+	}
+
+	bundle.Slots = make([]ProvisioningSlot, numSlots)
+	for i := range bundle.Slots {
+		slot := buf[i*slotSize : (i+1)*slotSize]
+		copy(bundle.Slots[i].Key[:], slot[:AESKeySize])
+		bundle.Slots[i].EncryptedKey = slot[AESKeySize:]
+	}
+	return true
+}
+
+// SealProvisioningBundle encrypts a marshalled ProvisioningBundle with a
+// symmetric key shared with the device (for example, one installed when the
+// device was manufactured), so that the bundle can be delivered over an
+// untrusted channel. The sealed bundle is a random 12-byte nonce followed by
+// the AES-GCM encryption of the marshalled bundle.
+func SealProvisioningBundle(bundle *ProvisioningBundle, deviceKey []byte) ([]byte, error) {
+	aead, err := newProvisioningAEAD(deviceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealWithAEAD(aead, bundle.Marshal(), nil)
+}
+
+// OpenProvisioningBundle decrypts and unmarshals a bundle sealed with
+// SealProvisioningBundle.
+func OpenProvisioningBundle(sealed []byte, deviceKey []byte) (*ProvisioningBundle, error) {
+	aead, err := newProvisioningAEAD(deviceKey)
+	if err != nil {
+		return nil, err
+	}
+	marshalled, err := openWithAEAD(aead, sealed, nil)
+	if err != nil {
+		return nil, errors.New("sealed provisioning bundle failed authentication")
+	}
+
+	bundle := new(ProvisioningBundle)
+	if !bundle.Unmarshal(marshalled) {
+		return nil, errors.New("malformed provisioning bundle")
+	}
+	return bundle, nil
+}
+
+func newProvisioningAEAD(deviceKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deviceKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
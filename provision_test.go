@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestProvisioningBundle(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	provisioner := NewClientState(info, store, encoder, 1<<20)
+	subscriber := NewClientState(info, store, encoder, 1<<20)
+	start := time.Date(2019, time.August, 6, 22, 30, 0, 0, time.UTC)
+	end := start.Add(3 * time.Hour)
+	ctx := context.Background()
+
+	var bundle *ProvisioningBundle
+	if bundle, err = provisioner.Provision(ctx, TestHierarchy, "a/b/c", start, end); err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Slots) != 4 {
+		t.Fatalf("Expected 4 slots, got %d", len(bundle.Slots))
+	}
+
+	deviceKey := make([]byte, AESKeySize)
+	if _, err = rand.Read(deviceKey); err != nil {
+		t.Fatal(err)
+	}
+	var sealed []byte
+	if sealed, err = SealProvisioningBundle(bundle, deviceKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenProvisioningBundle(sealed, make([]byte, AESKeySize)); err == nil {
+		t.Fatal("Opened a provisioning bundle with the wrong device key")
+	}
+	if bundle, err = OpenProvisioningBundle(sealed, deviceKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for timestamp := start; timestamp.Before(end); timestamp = timestamp.Add(time.Hour) {
+		var encrypted []byte
+		if encrypted, err = bundle.Encrypt(timestamp, []byte(quote1)); err != nil {
+			t.Fatal(err)
+		}
+		var decrypted []byte
+		if decrypted, err = subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", timestamp, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte(quote1)) {
+			t.Fatalf("Original and decrypted messages differ at %v", timestamp)
+		}
+	}
+
+	if _, err = bundle.Encrypt(end.Add(time.Hour), []byte(quote1)); err == nil {
+		t.Fatal("No error for encrypting outside the provisioned window")
+	}
+}
+
+func TestProvisioningBundleUnversioned(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	provisioner := NewClientState(info, store, encoder, 1<<20, WithLegacyKeyDerivation(), WithUnversionedMessages())
+	subscriber := NewClientState(info, store, encoder, 1<<20, WithLegacyKeyDerivation(), WithUnversionedMessages())
+	start := time.Date(2019, time.August, 6, 22, 30, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+	ctx := context.Background()
+
+	var bundle *ProvisioningBundle
+	if bundle, err = provisioner.Provision(ctx, TestHierarchy, "a/b/c", start, end); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The bundle's slots, and its messages, omit the epoch. */
+	unmarshalled := new(ProvisioningBundle)
+	if !unmarshalled.Unmarshal(bundle.Marshal()) {
+		t.Fatal("Could not unmarshal an unversioned provisioning bundle")
+	}
+	for _, slot := range unmarshalled.Slots {
+		if len(slot.EncryptedKey) != EncryptedKeySize-ParamEpochLength {
+			t.Fatalf("Unversioned slot has a %d-byte encrypted key", len(slot.EncryptedKey))
+		}
+	}
+
+	for timestamp := start; timestamp.Before(end); timestamp = timestamp.Add(time.Hour) {
+		var encrypted []byte
+		if encrypted, err = unmarshalled.Encrypt(timestamp, []byte(quote1)); err != nil {
+			t.Fatal(err)
+		}
+		var decrypted []byte
+		if decrypted, err = subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", timestamp, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte(quote1)) {
+			t.Fatalf("Original and decrypted messages differ at %v", timestamp)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// SegmentRecord is a single timestamped record in a time-series archive.
+type SegmentRecord struct {
+	Timestamp time.Time
+	Data      []byte
+}
+
+// Segment contains the records for a URI within a single hour, encrypted
+// together under one WKD-IBE ciphertext. The URI and hour are stored in the
+// clear, since they are needed to decrypt the segment; the timestamps and
+// contents of the records are encrypted.
+type Segment struct {
+	URI        string
+	Hour       time.Time
+	Ciphertext []byte
+}
+
+// SegmentSink receives segments as a SegmentWriter seals them.
+type SegmentSink interface {
+	PutSegment(ctx context.Context, segment *Segment) error
+}
+
+// SegmentSource provides the segments stored for a URI and hour, for use by
+// QuerySegments. There may be multiple segments for the same URI and hour, if
+// records for that hour were appended after the segment was sealed.
+type SegmentSource interface {
+	SegmentsForHour(ctx context.Context, uri string, hour time.Time) ([]*Segment, error)
+}
+
+// segmentHour returns the start of the hour containing the timestamp, which
+// identifies the TimePath used to encrypt records with that timestamp.
+func segmentHour(timestamp time.Time) time.Time {
+	return timestamp.UTC().Truncate(time.Hour)
+}
+
+// SegmentWriter groups records by URI and hour, and encrypts the records in
+// each hour into a single Segment. Records should be appended in roughly
+// chronological order for each URI; a segment is sealed when a record for a
+// different hour is appended for the same URI.
+type SegmentWriter struct {
+	state     *ClientState
+	hierarchy []byte
+	sink      SegmentSink
+	open      map[string]*Segment
+	records   map[string][]SegmentRecord
+}
+
+// NewSegmentWriter creates a new SegmentWriter that encrypts segments using
+// the provided ClientState and hierarchy, and writes them to the sink.
+func NewSegmentWriter(state *ClientState, hierarchy []byte, sink SegmentSink) *SegmentWriter {
+	return &SegmentWriter{
+		state:     state,
+		hierarchy: hierarchy,
+		sink:      sink,
+		open:      make(map[string]*Segment),
+		records:   make(map[string][]SegmentRecord),
+	}
+}
+
+// Append adds a record for a URI. If the URI has an open segment for a
+// different hour, that segment is sealed first.
+func (sw *SegmentWriter) Append(ctx context.Context, uri string, timestamp time.Time, data []byte) error {
+	hour := segmentHour(timestamp)
+	if segment, ok := sw.open[uri]; ok && !segment.Hour.Equal(hour) {
+		if err := sw.seal(ctx, uri); err != nil {
+			return err
+		}
+	}
+	if _, ok := sw.open[uri]; !ok {
+		sw.open[uri] = &Segment{URI: uri, Hour: hour}
+	}
+	sw.records[uri] = append(sw.records[uri], SegmentRecord{Timestamp: timestamp, Data: data})
+	return nil
+}
+
+// Close seals all open segments.
+func (sw *SegmentWriter) Close(ctx context.Context) error {
+	for uri := range sw.open {
+		if err := sw.seal(ctx, uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal encrypts the open segment for a URI and writes it to the sink.
+func (sw *SegmentWriter) seal(ctx context.Context, uri string) error {
+	segment := sw.open[uri]
+	records := sw.records[uri]
+
+	var err error
+	if segment.Ciphertext, err = sw.state.Encrypt(ctx, sw.hierarchy, uri, segment.Hour, encodeSegmentRecords(records)); err != nil {
+		return err
+	}
+	if err = sw.sink.PutSegment(ctx, segment); err != nil {
+		return err
+	}
+
+	delete(sw.open, uri)
+	delete(sw.records, uri)
+	return nil
+}
+
+// The plaintext of a segment consists of the number of records, followed by
+// an index with the timestamp (in nanoseconds since the Unix epoch) and the
+// offset of each record's data, followed by the data of all records. Records
+// are sorted by timestamp, so the index can be binary-searched.
+const segmentIndexEntrySize = 8 + MarshalledLengthLength
+
+func encodeSegmentRecords(records []SegmentRecord) []byte {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+
+	size := MarshalledLengthLength + len(records)*segmentIndexEntrySize
+	for _, record := range records {
+		size += len(record.Data)
+	}
+
+	buf := make([]byte, MarshalledLengthLength, size)
+	putLength(buf, len(records))
+	offset := 0
+	for _, record := range records {
+		var entry [segmentIndexEntrySize]byte
+		binary.LittleEndian.PutUint64(entry[:8], uint64(record.Timestamp.UnixNano()))
+		putLength(entry[8:], offset)
+		buf = append(buf, entry[:]...)
+		offset += len(record.Data)
+	}
+	for _, record := range records {
+		buf = append(buf, record.Data...)
+	}
+	return buf
+}
+
+// decodeSegmentRecords returns the records in an encoded segment whose
+// timestamps are in the range [start, end).
+func decodeSegmentRecords(encoded []byte, start time.Time, end time.Time) ([]SegmentRecord, error) {
+	malformed := errors.New("malformed segment")
+	if len(encoded) < MarshalledLengthLength {
+		return nil, malformed
+	}
+	count, buf := unmarshalPrefixLength(encoded)
+	if count > len(buf)/segmentIndexEntrySize {
+		return nil, malformed
+	}
+	index := buf[:count*segmentIndexEntrySize]
+	data := buf[count*segmentIndexEntrySize:]
+
+	timestamp := func(i int) int64 {
+		return int64(binary.LittleEndian.Uint64(index[i*segmentIndexEntrySize:]))
+	}
+	offset := func(i int) int {
+		if i == count {
+			return len(data)
+		}
+		return getLength(index[i*segmentIndexEntrySize+8:])
+	}
+
+	first := sort.Search(count, func(i int) bool { return timestamp(i) >= start.UnixNano() })
+	records := make([]SegmentRecord, 0)
+	for i := first; i != count && timestamp(i) < end.UnixNano(); i++ {
+		from, to := offset(i), offset(i+1)
+		if from > to || to > len(data) {
+			return nil, malformed
+		}
+		records = append(records, SegmentRecord{
+			Timestamp: time.Unix(0, timestamp(i)),
+			Data:      data[from:to],
+		})
+	}
+	return records, nil
+}
+
+// QuerySegments decrypts the records for a URI with timestamps in the range
+// [start, end), reading segments from the provided source. Hours for which
+// the key store has no key are skipped, so that the result contains exactly
+// the records in the hours that have been delegated to the caller. The
+// returned records are sorted by timestamp.
+func (state *ClientState) QuerySegments(ctx context.Context, hierarchy []byte, uri string, start time.Time, end time.Time, source SegmentSource) ([]SegmentRecord, error) {
+	records := make([]SegmentRecord, 0)
+	for hour := segmentHour(start); hour.Before(end); hour = hour.Add(time.Hour) {
+		segments, err := source.SegmentsForHour(ctx, uri, hour)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, segment := range segments {
+			encoded, err := state.Decrypt(ctx, hierarchy, uri, hour, segment.Ciphertext)
+			if errors.Is(err, ErrKeyNotFound) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			matching, err := decodeSegmentRecords(encoded, start, end)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, matching...)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records, nil
+}
+
+// Marshal encodes a Segment into a byte slice.
+func (s *Segment) Marshal() []byte {
+	buf := newMessageBuffer(64+len(s.URI)+len(s.Ciphertext), MarshalledTypeSegment)
+	buf = marshalAppendWithLength(newMarshallableBytes([]byte(s.URI)), buf)
+
+	var hour [8]byte
+	binary.LittleEndian.PutUint64(hour[:], uint64(s.Hour.Unix()))
+	buf = append(buf, hour[:]...)
+
+	buf = marshalAppendWithLength(newMarshallableBytes(s.Ciphertext), buf)
+	return buf
+}
+
+// Unmarshal decodes a Segment from a byte slice encoded with Marshal().
+func (s *Segment) Unmarshal(marshalled []byte) bool {
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeSegment); buf == nil {
+		return false
+	}
+
+	var uri marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&uri, buf); buf == nil || len(buf) < 8 {
+		return false
+	}
+	s.URI = string(uri.b)
+
+	s.Hour = time.Unix(int64(binary.LittleEndian.Uint64(buf[:8])), 0).UTC()
+	buf = buf[8:]
+
+	var ciphertext marshallableBytes
+	if buf, _ = unmarshalPrefixWithLength(&ciphertext, buf); buf == nil {
+		return false
+	}
+	s.Ciphertext = ciphertext.b
+
+	return true
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+type testSegmentStore struct {
+	segments map[string][][]byte
+}
+
+func (tss *testSegmentStore) PutSegment(ctx context.Context, segment *Segment) error {
+	key := fmt.Sprintf("%s@%d", segment.URI, segment.Hour.Unix())
+	tss.segments[key] = append(tss.segments[key], segment.Marshal())
+	return nil
+}
+
+func (tss *testSegmentStore) SegmentsForHour(ctx context.Context, uri string, hour time.Time) ([]*Segment, error) {
+	var segments []*Segment
+	for _, marshalled := range tss.segments[fmt.Sprintf("%s@%d", uri, hour.Unix())] {
+		segment := new(Segment)
+		if !segment.Unmarshal(marshalled) {
+			return nil, fmt.Errorf("could not unmarshal segment")
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+type grantedKeyStore struct {
+	KeyStoreReader
+	granted []Pattern
+}
+
+func (gks *grantedKeyStore) KeyForPattern(ctx context.Context, hierarchy []byte, pattern Pattern) (*wkdibe.Params, *wkdibe.SecretKey, error) {
+	for _, granted := range gks.granted {
+		if granted.Equals(pattern) {
+			return gks.KeyStoreReader.KeyForPattern(ctx, hierarchy, pattern)
+		}
+	}
+	return nil, nil, nil
+}
+
+func TestSegmentQuery(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	writerState := NewClientState(info, store, encoder, 1<<20)
+	start := time.Date(2019, time.August, 6, 10, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	archive := &testSegmentStore{segments: make(map[string][][]byte)}
+	writer := NewSegmentWriter(writerState, TestHierarchy, archive)
+	for minutes := 0; minutes != 4*60; minutes += 15 {
+		timestamp := start.Add(time.Duration(minutes) * time.Minute)
+		if err = writer.Append(ctx, "a/b/c", timestamp, []byte(timestamp.String())); err != nil {
+			t.Fatal(err)
+		}
+		if err = writer.Append(ctx, "a/b/d", timestamp, []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.segments) != 8 {
+		t.Fatalf("Expected 8 segments, got %d", len(archive.segments))
+	}
+
+	/* The reader is only granted the second and third hours. */
+	uriPath, err := ParseURI("a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := &grantedKeyStore{KeyStoreReader: store}
+	for _, hour := range []time.Time{start.Add(time.Hour), start.Add(2 * time.Hour)} {
+		timePath, err := ParseTime(hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		granted.granted = append(granted.granted, encoder.Encode(uriPath, timePath, PatternTypeDecryption))
+	}
+	readerState := NewClientState(info, granted, encoder, 1<<20)
+
+	queryStart := start.Add(30 * time.Minute)
+	queryEnd := start.Add(2*time.Hour + 30*time.Minute)
+	var records []SegmentRecord
+	if records, err = readerState.QuerySegments(ctx, TestHierarchy, "a/b/c", queryStart, queryEnd, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := start.Add(time.Hour)
+	for _, record := range records {
+		if !record.Timestamp.Equal(expected) {
+			t.Fatalf("Got record at %v, expected %v", record.Timestamp, expected)
+		}
+		if !bytes.Equal(record.Data, []byte(expected.String())) {
+			t.Fatal("Record data differs from original")
+		}
+		expected = expected.Add(15 * time.Minute)
+	}
+	if !expected.Equal(queryEnd) {
+		t.Fatalf("Query returned records up to %v, expected up to %v", expected, queryEnd)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// shardedCache is an implementation of Cache that spreads its objects across
+// many independently-locked LRU shards, so that concurrent lookups of
+// different objects rarely contend for a lock. As in lruCache, objects of
+// kinds with their own budget are kept in a separate pool of shards.
+type shardedCache struct {
+	seed   maphash.Seed
+	shared *shardedPool
+	pools  [numCacheKinds]*shardedPool
+}
+
+// shardedPool is a set of shards whose total size is bounded by a single
+// capacity. Each shard evicts its own least recently used objects, so
+// eviction is approximately LRU across the pool. Lookups that hit in the
+// cache only mark the object as referenced, holding the shard's lock as a
+// reader, so that frequently used objects (such as a hierarchy's public
+// parameters) don't serialize lookups; referenced objects are given a second
+// chance when they reach the end of the shard's LRU list.
+type shardedPool struct {
+	capacity uint64
+	size     uint64
+	shards   []*cacheShard
+}
+
+// cacheShard is an LRU cache holding part of a shardedPool's objects.
+type cacheShard struct {
+	lock    sync.RWMutex
+	entries map[lruCacheKey]*shardEntry
+	order   *list.List
+}
+
+// shardEntry is an object in a cacheShard. While the object is being loaded,
+// ready is open and elem is nil.
+type shardEntry struct {
+	key        lruCacheKey
+	value      interface{}
+	size       uint64
+	err        error
+	elem       *list.Element
+	ready      chan struct{}
+	referenced uint32
+}
+
+// NewShardedCache creates a new Cache that behaves like the one created by
+// NewLRUCache with the same configuration, but is split into the provided
+// number of shards (or GOMAXPROCS shards, if it is not positive) to reduce
+// lock contention when many goroutines use it at once. The capacity and
+// budgets apply to all shards together.
+func NewShardedCache(config CacheConfig, shards int) Cache {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	cache := &shardedCache{seed: maphash.MakeSeed()}
+	cache.shared = newShardedPool(config.Capacity, shards)
+	for kind := range cache.pools {
+		if budget, ok := config.Budgets[CacheKind(kind)]; ok {
+			cache.pools[kind] = newShardedPool(budget, shards)
+		} else {
+			cache.pools[kind] = cache.shared
+		}
+	}
+	return cache
+}
+
+func newShardedPool(capacity uint64, shards int) *shardedPool {
+	pool := &shardedPool{
+		capacity: capacity,
+		shards:   make([]*cacheShard, shards),
+	}
+	for i := range pool.shards {
+		pool.shards[i] = &cacheShard{
+			entries: make(map[lruCacheKey]*shardEntry),
+			order:   list.New(),
+		}
+	}
+	return pool
+}
+
+// locate returns the pool, and the index of the shard within it, that holds
+// the object of the provided kind stored under key.
+func (cache *shardedCache) locate(kind CacheKind, key string) (*shardedPool, int) {
+	pool := cache.shared
+	if kind >= 0 && kind < numCacheKinds {
+		pool = cache.pools[kind]
+	}
+	return pool, int(maphash.String(cache.seed, key) % uint64(len(pool.shards)))
+}
+
+// Get implements the Cache interface.
+func (cache *shardedCache) Get(ctx context.Context, loader CacheLoader, kind CacheKind, key string) (interface{}, error) {
+	pool, index := cache.locate(kind, key)
+	shard := pool.shards[index]
+	k := lruCacheKey{loader: loader, key: key}
+
+	shard.lock.RLock()
+	entry, ok := shard.entries[k]
+	if ok && entry.elem != nil {
+		atomic.StoreUint32(&entry.referenced, 1)
+		shard.lock.RUnlock()
+		return entry.value, nil
+	}
+	shard.lock.RUnlock()
+
+	if !ok {
+		/*
+		 * Since we dropped the lock as a reader, another goroutine may have
+		 * started loading the object, so check again as a writer.
+		 */
+		shard.lock.Lock()
+		if entry, ok = shard.entries[k]; !ok {
+			entry = &shardEntry{key: k, ready: make(chan struct{})}
+			shard.entries[k] = entry
+			shard.lock.Unlock()
+			return cache.load(ctx, pool, index, entry)
+		}
+		shard.lock.Unlock()
+	}
+
+	/* Another goroutine is loading (or has loaded) the object. */
+	select {
+	case <-entry.ready:
+		return entry.value, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// load loads an object into a pending entry that the caller inserted into
+// the shard at the provided index.
+func (cache *shardedCache) load(ctx context.Context, pool *shardedPool, index int, entry *shardEntry) (interface{}, error) {
+	shard := pool.shards[index]
+	k := entry.key
+
+	value, size, err := k.loader.Load(ctx, k.key)
+
+	shard.lock.Lock()
+	entry.value, entry.size, entry.err = value, size, err
+	if err != nil {
+		delete(shard.entries, k)
+	} else {
+		entry.elem = shard.order.PushFront(entry)
+		atomic.AddUint64(&pool.size, size)
+	}
+	shard.lock.Unlock()
+	close(entry.ready)
+
+	if err == nil {
+		pool.reclaim(index)
+	}
+	return value, err
+}
+
+// Evict implements the Cache interface.
+func (cache *shardedCache) Evict(loader CacheLoader, kind CacheKind, key string) {
+	pool, index := cache.locate(kind, key)
+	shard := pool.shards[index]
+	k := lruCacheKey{loader: loader, key: key}
+
+	shard.lock.Lock()
+	entry, ok := shard.entries[k]
+	if !ok || entry.elem == nil {
+		shard.lock.Unlock()
+		return
+	}
+	shard.remove(pool, entry)
+	shard.lock.Unlock()
+
+	loader.Evicted(key, entry.value)
+}
+
+// remove removes a loaded entry from the shard, which must be locked.
+func (shard *cacheShard) remove(pool *shardedPool, entry *shardEntry) {
+	shard.order.Remove(entry.elem)
+	delete(shard.entries, entry.key)
+	atomic.AddUint64(&pool.size, ^(entry.size - 1))
+}
+
+// reclaim evicts objects until the pool is within its capacity. It starts
+// with the shard at the provided index, where an entry was just inserted,
+// and moves on to the other shards only if that shard has nothing left to
+// evict. As in lruCache, the inserted entry may itself be evicted if the
+// pool is too small to hold it; its value is still returned to the caller
+// that loaded it. Only one shard is locked at a time.
+func (pool *shardedPool) reclaim(start int) {
+	for i := 0; i != len(pool.shards) && atomic.LoadUint64(&pool.size) > pool.capacity; i++ {
+		shard := pool.shards[(start+i)%len(pool.shards)]
+
+		var evicted []*shardEntry
+		shard.lock.Lock()
+		for atomic.LoadUint64(&pool.size) > pool.capacity && shard.order.Len() != 0 {
+			entry := shard.order.Back().Value.(*shardEntry)
+			if atomic.SwapUint32(&entry.referenced, 0) == 1 {
+				/* Give recently used objects a second chance. */
+				shard.order.MoveToFront(entry.elem)
+				continue
+			}
+			shard.remove(pool, entry)
+			evicted = append(evicted, entry)
+		}
+		shard.lock.Unlock()
+
+		for _, entry := range evicted {
+			entry.key.loader.Evicted(entry.key.key, entry.value)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixedSizeLoader is a CacheLoader that creates objects of a fixed size, and
+// keeps track of the total size of the objects in the cache.
+type fixedSizeLoader struct {
+	size  uint64
+	live  int64
+	loads int64
+}
+
+func (fsl *fixedSizeLoader) Load(ctx context.Context, key string) (interface{}, uint64, error) {
+	atomic.AddInt64(&fsl.loads, 1)
+	atomic.AddInt64(&fsl.live, int64(fsl.size))
+	return key, fsl.size, nil
+}
+
+func (fsl *fixedSizeLoader) Evicted(key string, value interface{}) {
+	atomic.AddInt64(&fsl.live, -int64(fsl.size))
+}
+
+func TestShardedCacheCapacity(t *testing.T) {
+	ctx := context.Background()
+	cache := NewShardedCache(CacheConfig{Capacity: 100}, 4)
+	loader := &fixedSizeLoader{size: 10}
+
+	for i := 0; i != 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, err := cache.Get(ctx, loader, CacheKindDecryption, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.(string) != key {
+			t.Fatal("Cache returned the wrong object")
+		}
+		if live := atomic.LoadInt64(&loader.live); live > 100 {
+			t.Fatalf("Cache exceeded its capacity: %d bytes", live)
+		}
+	}
+
+	cache.Evict(loader, CacheKindDecryption, "key999")
+	if live := atomic.LoadInt64(&loader.live); live > 90 {
+		t.Fatalf("Evicted object was not released: %d bytes", live)
+	}
+}
+
+func TestShardedCacheZeroBudget(t *testing.T) {
+	ctx := context.Background()
+	config := CacheConfig{
+		Capacity: 100,
+		Budgets:  map[CacheKind]uint64{CacheKindDecryption: 0},
+	}
+	caches := map[string]Cache{
+		"lru":     NewLRUCache(config),
+		"sharded": NewShardedCache(config, 4),
+	}
+
+	for name, cache := range caches {
+		loader := &fixedSizeLoader{size: 10}
+		for i := 0; i != 10; i++ {
+			key := fmt.Sprintf("key%d", i)
+			value, err := cache.Get(ctx, loader, CacheKindDecryption, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value.(string) != key {
+				t.Fatalf("%s: cache returned the wrong object", name)
+			}
+			if live := atomic.LoadInt64(&loader.live); live != 0 {
+				t.Fatalf("%s: cache kept %d bytes with a zero budget", name, live)
+			}
+		}
+		if loads := atomic.LoadInt64(&loader.loads); loads != 10 {
+			t.Fatalf("%s: expected 10 loads, got %d", name, loads)
+		}
+	}
+}
+
+func TestShardedCacheSecondChance(t *testing.T) {
+	ctx := context.Background()
+	cache := NewShardedCache(CacheConfig{Capacity: 100}, 1)
+	hot := &fixedSizeLoader{size: 10}
+	cold := &fixedSizeLoader{size: 10}
+
+	for i := 0; i != 100; i++ {
+		if _, err := cache.Get(ctx, hot, CacheKindHierarchy, "hot"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Get(ctx, cold, CacheKindHierarchy, fmt.Sprintf("cold%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if loads := atomic.LoadInt64(&hot.loads); loads != 1 {
+		t.Fatalf("Frequently used object was loaded %d times", loads)
+	}
+}
+
+func TestShardedCacheConcurrent(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	cache := NewShardedCache(CacheConfig{Capacity: 1 << 20}, 8)
+	state := NewClientState(info, store, encoder, 0, WithCache(cache))
+	now := time.Now()
+
+	const workers = 16
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i != workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uri := fmt.Sprintf("a/b/%d", i%4)
+			errs <- transferMessage(state, TestHierarchy, uri, now, quote1)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+/*
+ * The following benchmarks compare lock contention in the default LRU cache
+ * and the sharded cache, when many goroutines use the cache at once. Run them
+ * with -cpu to vary the amount of parallelism.
+ */
+
+func benchmarkCacheGet(b *testing.B, cache Cache) {
+	ctx := context.Background()
+	loader := &fixedSizeLoader{size: 1}
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		if _, err := cache.Get(ctx, loader, CacheKindEncryption, keys[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&next, 97))
+		for pb.Next() {
+			if _, err := cache.Get(ctx, loader, CacheKindEncryption, keys[i%len(keys)]); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	b.Run("lru", func(b *testing.B) {
+		benchmarkCacheGet(b, NewLRUCache(CacheConfig{Capacity: 1 << 20}))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkCacheGet(b, NewShardedCache(CacheConfig{Capacity: 1 << 20}, 0))
+	})
+}
+
+func benchmarkEncrypt(b *testing.B, cache Cache) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(info, store, encoder, 0, WithCache(cache))
+	ctx := context.Background()
+	now := time.Now()
+	message := []byte(quote1)
+
+	uris := make([]string, 64)
+	for i := range uris {
+		uris[i] = fmt.Sprintf("a/b/%d", i)
+		if _, err := state.Encrypt(ctx, TestHierarchy, uris[i], now, message); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&next, 1))
+		for pb.Next() {
+			if _, err := state.Encrypt(ctx, TestHierarchy, uris[i%len(uris)], now, message); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkEncryptCachedParallel(b *testing.B) {
+	b.Run("lru", func(b *testing.B) {
+		benchmarkEncrypt(b, NewLRUCache(CacheConfig{Capacity: 1 << 20}))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkEncrypt(b, NewShardedCache(CacheConfig{Capacity: 1 << 20}, 0))
+	})
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
+)
+
+// Flags in the header of a snapshot.
+const (
+	snapshotFlagLegacyKeyDerivation = 1 << iota
+)
+
+// Snapshot writes the encryption entries in the ClientState's cache to w,
+// sealed with AES-GCM under localKey, which must be 16, 24, or 32 bytes long
+// and should be known only to this service. After a restart, Restore loads
+// them into a new ClientState, so that it keeps using the same symmetric key
+// and WKD-IBE ciphertext for each URI (and for each of its recent hours, see
+// WithEncryptionSlots), instead of encrypting new ones for every URI at once.
+//
+// The sealed snapshot is a random 12-byte nonce followed by the AES-GCM
+// encryption of the following layout, with all integers in little-endian
+// byte order:
+//
+//	1 byte                  MarshalledTypeEncryptionSnapshot
+//	1 byte                  flags
+//	4 bytes                 number of slots
+//	for each slot of each encryption cache entry:
+//	  4 bytes + length        hierarchy
+//	  4 bytes + length        URI path, as marshalled by URIToBytes
+//	  8 bytes                 time of the pattern, in seconds since the Unix epoch
+//	  4 bytes + length        pattern
+//	  EncryptedKeySize bytes  epoch and WKD-IBE ciphertext of the key
+//	  AESKeySize bytes        AES-CTR key
+//
+// The pairing library cannot marshal the precomputation for a pattern, so it
+// is not included. A restored entry computes it from scratch the first time
+// that its URI is encrypted with a different pattern or cipher suite.
+func (state *ClientState) Snapshot(w io.Writer, localKey []byte) error {
+	aead, err := newSnapshotAEAD(localKey)
+	if err != nil {
+		return err
+	}
+
+	loader := state.loader
+	loader.lock.Lock()
+	entries := make(map[string]*encryptionCacheEntry)
+	for key, value := range loader.live {
+		if entry, ok := value.(*encryptionCacheEntry); ok {
+			entries[key] = entry
+		}
+	}
+	loader.lock.Unlock()
+
+	var flags byte
+	if state.legacyKeyDerivation {
+		flags |= snapshotFlagLegacyKeyDerivation
+	}
+
+	/*
+	 * Copy out the slots first, so that the snapshot's exact size is known
+	 * and its buffer is allocated once; growing it with append would leave
+	 * copies of the keys in the buffers it outgrew. The copies of the keys
+	 * made here are wiped when we return.
+	 */
+	var records []*snapshotSlot
+	defer func() {
+		for _, record := range records {
+			zeroBytes(record.key[:])
+		}
+	}()
+	size := 2 + MarshalledLengthLength
+	for key, entry := range entries {
+		_, ns := parsekey(key)
+
+		/*
+		 * Write the slots from the least to the most recently used, so
+		 * that Restore reproduces their order.
+		 */
+		entry.lock.RLock()
+		slots := append([]*encryptionSlot(nil), entry.slots...)
+		sort.Slice(slots, func(i, j int) bool {
+			return atomic.LoadUint64(&slots[i].used) < atomic.LoadUint64(&slots[j].used)
+		})
+		for _, slot := range slots {
+			if slot.pattern == nil {
+				continue
+			}
+			record := &snapshotSlot{
+				hierarchy:    ns,
+				uri:          URIToBytes(entry.uriPath),
+				timestamp:    slot.timestamp,
+				pattern:      slot.pattern.Marshal(),
+				encryptedKey: make([]byte, EncryptedKeySize),
+			}
+			records = append(records, record)
+			marshalEncryptedKey(record.encryptedKey, slot.epoch, slot.encryptedKey)
+			copy(record.key[:], slot.material.key[:])
+			size += record.size()
+		}
+		entry.lock.RUnlock()
+	}
+
+	buf := newMessageBuffer(size, MarshalledTypeEncryptionSnapshot)
+	defer zeroBytes(buf[:cap(buf)])
+	buf = append(buf, flags)
+	buf = marshalAppendLength(len(records), buf)
+	for _, record := range records {
+		buf = record.marshalAppend(buf)
+	}
+
+	sealed, err := sealWithAEAD(aead, buf, nil)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// snapshotSlot is one slot of an encryption cache entry, copied out of the
+// entry to be written to a snapshot.
+type snapshotSlot struct {
+	hierarchy    []byte
+	uri          []byte
+	timestamp    time.Time
+	pattern      []byte
+	encryptedKey []byte
+	key          [AESKeySize]byte
+}
+
+// size returns the number of bytes that marshalAppend appends.
+func (record *snapshotSlot) size() int {
+	return 3*MarshalledLengthLength + len(record.hierarchy) + len(record.uri) + 8 + len(record.pattern) + EncryptedKeySize + AESKeySize
+}
+
+// marshalAppend appends the slot, in the layout described by Snapshot, to
+// buf.
+func (record *snapshotSlot) marshalAppend(buf []byte) []byte {
+	buf = marshalAppendWithLength(newMarshallableBytes(record.hierarchy), buf)
+	buf = marshalAppendWithLength(newMarshallableBytes(record.uri), buf)
+	var timestamp [8]byte
+	binary.LittleEndian.PutUint64(timestamp[:], uint64(record.timestamp.Unix()))
+	buf = append(buf, timestamp[:]...)
+	buf = marshalAppendWithLength(newMarshallableBytes(record.pattern), buf)
+	buf = append(buf, record.encryptedKey...)
+	return append(buf, record.key[:]...)
+}
+
+// Restore reads a snapshot written by Snapshot from r, and loads its
+// encryption entries into the ClientState's cache. It does not replace
+// entries, or slots of entries, that are already in the cache, and restores
+// only the most recently used patterns of each URI that fit in its slots
+// (see WithEncryptionSlots). If the ClientState evicts
+// encryption entries when their hour has passed (see WithEncryptionExpiry),
+// then entries that would already have expired are skipped. Entries produced
+// under an epoch of public parameters that is no longer the newest are
+// rebuilt the first time they are used.
+func (state *ClientState) Restore(r io.Reader, localKey []byte) error {
+	aead, err := newSnapshotAEAD(localKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	marshalled, err := openWithAEAD(aead, sealed, nil)
+	if err != nil {
+		return errors.New("snapshot failed authentication")
+	}
+	defer zeroBytes(marshalled)
+
+	var buf []byte
+	if buf = checkMessageType(marshalled, MarshalledTypeEncryptionSnapshot); buf == nil || len(buf) < 1 {
+		return errors.New("malformed snapshot")
+	}
+	legacy := buf[0]&snapshotFlagLegacyKeyDerivation != 0
+	if legacy != state.legacyKeyDerivation {
+		return errors.New("snapshot was taken with a different key derivation")
+	}
+
+	var count int
+	if count, buf = unmarshalPrefixLength(buf[1:]); buf == nil {
+		return errors.New("malformed snapshot")
+	}
+
+	now := time.Now()
+	records := make([]snapshotRecord, 0, count)
+	for i := 0; i != count; i++ {
+		var hierarchy marshallableBytes
+		if buf, _ = unmarshalPrefixWithLength(&hierarchy, buf); buf == nil {
+			return errors.New("malformed snapshot")
+		}
+		var uri marshallableBytes
+		if buf, _ = unmarshalPrefixWithLength(&uri, buf); buf == nil || len(uri.b) == 0 {
+			return errors.New("malformed snapshot")
+		}
+		if len(buf) < 8 {
+			return errors.New("malformed snapshot")
+		}
+		timestamp := time.Unix(int64(binary.LittleEndian.Uint64(buf[:8])), 0)
+		buf = buf[8:]
+		var marshalledPattern marshallableBytes
+		if buf, _ = unmarshalPrefixWithLength(&marshalledPattern, buf); buf == nil {
+			return errors.New("malformed snapshot")
+		}
+		if len(buf) < EncryptedKeySize+AESKeySize {
+			return errors.New("malformed snapshot")
+		}
+		encryptedKey := buf[:EncryptedKeySize]
+		marshalledKey := buf[EncryptedKeySize : EncryptedKeySize+AESKeySize]
+		buf = buf[EncryptedKeySize+AESKeySize:]
+
+		/*
+		 * The URI and pattern are kept in the cache, so they are copied out
+		 * of the snapshot, which is wiped when we return.
+		 */
+		uriPath := URIFromBytes(append([]byte(nil), uri.b...))
+		var pattern Pattern
+		if !pattern.Unmarshal(append([]byte(nil), marshalledPattern.b...)) || state.checkPattern(pattern) != nil {
+			return errors.New("malformed snapshot")
+		}
+
+		/* The snapshot is authenticated, so the ciphertext is trusted. */
+		ciphertext := new(wkdibe.Ciphertext)
+		if !ciphertext.Unmarshal(encryptedKey[ParamEpochLength:], true, false) {
+			return errors.New("malformed snapshot")
+		}
+
+		if state.encryptionExpiry && !now.Before(state.encryptionDeadline(timestamp)) {
+			continue
+		}
+		records = append(records, snapshotRecord{
+			hierarchy:  append([]byte(nil), hierarchy.b...),
+			cacheKey:   encryptionCacheKey(hierarchy.b, uriPath),
+			uriPath:    uriPath,
+			timestamp:  timestamp,
+			pattern:    pattern,
+			epoch:      encryptedKeyEpoch(encryptedKey),
+			ciphertext: ciphertext,
+			key:        marshalledKey,
+		})
+	}
+
+	/*
+	 * The records for each URI are in order of use, so restore only the most
+	 * recently used ones that fit in the URI's slots, in that order.
+	 */
+	restore := make([]bool, len(records))
+	slots := make(map[string]int)
+	for i := len(records) - 1; i != -1; i-- {
+		if slots[records[i].cacheKey] < state.encryptionSlots {
+			slots[records[i].cacheKey]++
+			restore[i] = true
+		}
+	}
+	for i := range records {
+		if !restore[i] {
+			continue
+		}
+		if err = state.restoreEncryptionSlot(&records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotRecord is the data for one slot of an encryption cache entry read
+// from a snapshot. The key is in the buffer of the snapshot, which is wiped
+// once it has been restored.
+type snapshotRecord struct {
+	hierarchy  []byte
+	cacheKey   string
+	uriPath    URIPath
+	timestamp  time.Time
+	pattern    Pattern
+	epoch      uint32
+	ciphertext *wkdibe.Ciphertext
+	key        []byte
+}
+
+// restoreEncryptionSlot populates a slot of the encryption entry for a URI
+// with the provided data from a snapshot, and adds the entry to the index of
+// nearby URIs, unless the entry already has a slot for the pattern or has no
+// room for another slot.
+func (state *ClientState) restoreEncryptionSlot(record *snapshotRecord) error {
+	entryInt, err := state.cacheGet(context.Background(), record.cacheKey)
+	if err != nil {
+		return err
+	}
+	entry := entryInt.(*encryptionCacheEntry)
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.wiped {
+		return nil
+	}
+	slot := entry.slotFor(record.pattern, state.encryptionSlots)
+	if slot.pattern != nil {
+		return nil
+	}
+	entry.uriPath = record.uriPath
+	slot.epoch = record.epoch
+	slot.timestamp = record.timestamp
+	slot.pattern = record.pattern
+	slot.attrs = nil
+	slot.precomputed = nil
+	slot.encryptedKey = record.ciphertext
+	if slot.material == nil {
+		slot.material = state.newKeyMaterial()
+	}
+	copy(slot.material.key[:], record.key)
+	slot.restored = true
+	entry.touch(slot)
+
+	/* Index the entry, as if its URI had just been encrypted. */
+	state.nearby.insert(record.hierarchy, entry.uriPath, entry)
+
+	if state.encryptionExpiry {
+		state.expiry.schedule(record.cacheKey, CacheKindEncryption, entry, state.encryptionDeadline(entry.latest()))
+	}
+	return nil
+}
+
+func newSnapshotAEAD(localKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(localKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func newTestSnapshotKey(t *testing.T) []byte {
+	key := make([]byte, AESKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	now := time.Now()
+	ctx := context.Background()
+	localKey := newTestSnapshotKey(t)
+
+	before := NewClientState(info, store, encoder, 1<<20)
+	var encrypted1 []byte
+	if encrypted1, err = before.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = before.Encrypt(ctx, TestHierarchy, "a/d", now, []byte(quote1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	if err = before.Snapshot(&snapshot, localKey); err != nil {
+		t.Fatal(err)
+	}
+	before.Close()
+
+	/* After a restart, the same header is used without any pairings. */
+	metrics := NewMetrics()
+	after := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics))
+	if err = after.Restore(bytes.NewReader(snapshot.Bytes()), localKey); err != nil {
+		t.Fatal(err)
+	}
+	if nearest := after.nearby.nearest(TestHierarchy, mustParseURI(t, "a/b/e")); nearest == nil || nearest.uriPath.String() != "a/b/c" {
+		t.Fatal("Restored entry is not in the index of nearby URIs")
+	}
+	var encrypted2 []byte
+	if encrypted2, err = after.Encrypt(ctx, TestHierarchy, "a/b/c", now, []byte(quote2)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encrypted1[:EncryptedKeySize], encrypted2[:EncryptedKeySize]) {
+		t.Fatal("Restored entry produced a different header")
+	}
+	for _, op := range []CryptoOperation{OperationPrepare, OperationAdjust, OperationEncrypt} {
+		if stats := metrics.OperationStats(op); stats.Count != 0 {
+			t.Fatalf("Restored entry performed %d %v operations", stats.Count, op)
+		}
+	}
+
+	subscriber := NewClientState(info, store, encoder, 1<<20)
+	for i, encrypted := range [][]byte{encrypted1, encrypted2} {
+		var decrypted []byte
+		if decrypted, err = subscriber.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, []byte([]string{quote1, quote2}[i])) {
+			t.Fatal("Original and decrypted messages differ")
+		}
+	}
+
+	/* Restored entries are rebuilt for other cipher suites and times. */
+	var blob bytes.Buffer
+	if err = after.EncryptBlob(ctx, TestHierarchy, "a/d", now, &blob, bytes.NewReader([]byte(quote1)), int64(len(quote1)), 64); err != nil {
+		t.Fatal(err)
+	}
+	var reader *BlobReader
+	if reader, err = subscriber.OpenBlob(ctx, TestHierarchy, "a/d", now, bytes.NewReader(blob.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	decrypted := make([]byte, len(quote1))
+	if _, err = reader.ReadAt(decrypted, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(decrypted) != quote1 {
+		t.Fatal("Original and decrypted blobs differ")
+	}
+	testMessageTransfer(t, after, TestHierarchy, "a/b/c", now.Add(time.Hour), quote1)
+}
+
+func TestRestoreRejected(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	localKey := newTestSnapshotKey(t)
+
+	state := NewClientState(info, store, encoder, 1<<20)
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", time.Now(), quote1)
+	var snapshot bytes.Buffer
+	if err = state.Snapshot(&snapshot, localKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = NewTestState().Restore(bytes.NewReader(snapshot.Bytes()), newTestSnapshotKey(t)); err == nil {
+		t.Fatal("Restored a snapshot with the wrong key")
+	}
+
+	tampered := append([]byte(nil), snapshot.Bytes()...)
+	tampered[len(tampered)-1] ^= 0x1
+	if err = NewTestState().Restore(bytes.NewReader(tampered), localKey); err == nil {
+		t.Fatal("Restored a tampered snapshot")
+	}
+
+	legacy := NewClientState(info, store, encoder, 1<<20, WithLegacyKeyDerivation())
+	if err = legacy.Restore(bytes.NewReader(snapshot.Bytes()), localKey); err == nil {
+		t.Fatal("Restored a snapshot taken with a different key derivation")
+	}
+}
+
+func TestRestoreExpired(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	localKey := newTestSnapshotKey(t)
+
+	state := NewClientState(info, store, encoder, 1<<20)
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", time.Now().Add(-2*time.Hour), quote1)
+	testMessageTransfer(t, state, TestHierarchy, "a/d", time.Now(), quote1)
+	var snapshot bytes.Buffer
+	if err = state.Snapshot(&snapshot, localKey); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewClientState(info, store, encoder, 1<<20, WithEncryptionExpiry(time.Minute))
+	if err = restored.Restore(bytes.NewReader(snapshot.Bytes()), localKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := liveEntries(restored)[encryptionCacheKey(TestHierarchy, mustParseURI(t, "a/b/c"))]; ok {
+		t.Fatal("Restored an entry whose hour has passed")
+	}
+	if _, ok := liveEntries(restored)[encryptionCacheKey(TestHierarchy, mustParseURI(t, "a/d"))]; !ok {
+		t.Fatal("Did not restore an entry for the current hour")
+	}
+}
+
+func mustParseURI(t *testing.T, uri string) URIPath {
+	uriPath, err := ParseURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uriPath
+}
+
+func TestSnapshotRestoreSlots(t *testing.T) {
+	var err error
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	now := time.Now()
+	backfill := now.Add(-2 * time.Hour)
+	localKey := newTestSnapshotKey(t)
+
+	before := NewClientState(info, store, encoder, 1<<20, WithEncryptionSlots(2))
+	headers := encryptHeaders(t, before, "a/b/c", []time.Time{now, backfill})
+
+	var snapshot bytes.Buffer
+	if err = before.Snapshot(&snapshot, localKey); err != nil {
+		t.Fatal(err)
+	}
+	before.Close()
+
+	/* Both slots are restored, and reused without any pairings. */
+	metrics := NewMetrics()
+	after := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics), WithEncryptionSlots(2))
+	if err = after.Restore(bytes.NewReader(snapshot.Bytes()), localKey); err != nil {
+		t.Fatal(err)
+	}
+	restored := encryptHeaders(t, after, "a/b/c", []time.Time{backfill, now})
+	if !bytes.Equal(headers[0], restored[1]) || !bytes.Equal(headers[1], restored[0]) {
+		t.Fatal("Restored slots produced different headers")
+	}
+	if count := metrics.OperationStats(OperationEncrypt).Count; count != 0 {
+		t.Fatalf("Restored slots performed %d encryptions", count)
+	}
+
+	/* With one slot, only the most recently used one is restored. */
+	single := NewClientState(info, store, encoder, 1<<20)
+	if err = single.Restore(bytes.NewReader(snapshot.Bytes()), localKey); err != nil {
+		t.Fatal(err)
+	}
+	if restored = encryptHeaders(t, single, "a/b/c", []time.Time{backfill}); !bytes.Equal(headers[1], restored[0]) {
+		t.Fatal("Most recently used slot was not restored")
+	}
+}
@@ -35,12 +35,158 @@ package jedi
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/cryptutils"
 )
 
 // AESKeySize is the key size to use with AES, in bytes.
 const AESKeySize = 16
 
+// These constants are mixed into each symmetric key derived from a WKD-IBE
+// plaintext. The label identifies the version of the key derivation, and the
+// cipher suite identifies the purpose for which the key is derived.
+const (
+	keyDerivationLabel   = "JEDI key derivation v1"
+	cipherSuiteAES128CTR = "AES-128-CTR"
+)
+
+// keyDerivationSecretSize is the size, in bytes, of the secret hashed from
+// the WKD-IBE plaintext that is used as input to HKDF.
+const keyDerivationSecretSize = 32
+
+// deriveSymmetricKey derives a symmetric key from the WKD-IBE plaintext
+// encryptable, and writes it into key. The hierarchy, pattern, and cipher
+// suite are bound into the derivation using HKDF, so that keys derived for
+// different hierarchies, patterns, or purposes are independent even if they
+// come from the same WKD-IBE plaintext.
+func deriveSymmetricKey(key []byte, encryptable *cryptutils.Encryptable, hierarchy []byte, pattern Pattern, cipherSuite string) error {
+	var secret [keyDerivationSecretSize]byte
+	encryptable.HashToSymmetricKey(secret[:])
+	defer zeroBytes(secret[:])
+
+	info := []byte(keyDerivationLabel)
+	info = marshalAppendWithLength(newMarshallableBytes([]byte(cipherSuite)), info)
+	info = marshalAppendWithLength(newMarshallableBytes(hierarchy), info)
+	info = marshalAppendWithLength(&pattern, info)
+
+	derived, err := hkdfKey(secret[:], nil, info, len(key))
+	if err != nil {
+		return err
+	}
+	copy(key, derived)
+	zeroBytes(derived)
+	return nil
+}
+
+// deriveLegacySymmetricKey derives a symmetric key from the WKD-IBE plaintext
+// encryptable by hashing it directly, as JEDI did before deriveSymmetricKey
+// was introduced. It is used only for ClientStates configured with
+// WithLegacyKeyDerivation, to interoperate with existing ciphertexts and
+// other JEDI implementations.
+func deriveLegacySymmetricKey(key []byte, encryptable *cryptutils.Encryptable) {
+	encryptable.HashToSymmetricKey(key)
+}
+
+// symmetricKey derives the symmetric key for the provided cipher suite from
+// the WKD-IBE plaintext encryptable, using the key derivation configured for
+// the ClientState.
+func (state *ClientState) symmetricKey(key []byte, encryptable *cryptutils.Encryptable, hierarchy []byte, pattern Pattern, cipherSuite string) error {
+	if state.legacyKeyDerivation && cipherSuite == cipherSuiteAES128CTR {
+		deriveLegacySymmetricKey(key, encryptable)
+		return nil
+	}
+	return deriveSymmetricKey(key, encryptable, hierarchy, pattern, cipherSuite)
+}
+
+// suiteKey returns the symmetric key for the provided cipher suite, given the
+// cached key material for a WKD-IBE plaintext. Cache entries store the
+// AES-CTR key, since it is used for most messages, and keys for other cipher
+// suites are derived from the plaintext when they are needed. The caller must
+// ensure that the key material is not wiped concurrently.
+func (state *ClientState) suiteKey(material *keyMaterial, hierarchy []byte, pattern Pattern, cipherSuite string) ([AESKeySize]byte, error) {
+	if cipherSuite == cipherSuiteAES128CTR {
+		return material.key, nil
+	}
+	var key [AESKeySize]byte
+	err := state.symmetricKey(key[:], &material.encryptable, hierarchy, pattern, cipherSuite)
+	return key, err
+}
+
+// hkdfKey implements HKDF (RFC 5869) with SHA-256, returning length bytes of
+// output keying material derived from the secret, salt, and info. The
+// intermediate keys are wiped before it returns.
+func hkdfKey(secret []byte, salt []byte, info []byte, length int) ([]byte, error) {
+	if length > 255*sha256.Size {
+		return nil, errors.New("requested HKDF output is too long")
+	}
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	defer zeroBytes(prk)
+
+	expand := hmac.New(sha256.New, prk)
+	var block []byte
+	okm := make([]byte, 0, length+sha256.Size)
+	for counter := byte(1); len(okm) < length; counter++ {
+		expand.Reset()
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		zeroBytes(block)
+		block = expand.Sum(block[:0])
+		okm = append(okm, block...)
+	}
+	zeroBytes(block)
+
+	result := make([]byte, length)
+	copy(result, okm)
+	zeroBytes(okm)
+	return result, nil
+}
+
+// newSubkeyAEAD derives a subkey from a symmetric key and a salt, for the
+// purpose identified by cipherSuite, and returns an AES-GCM AEAD using that
+// subkey. This allows a symmetric key obtained from JEDI to be used for
+// purposes other than encrypting messages with AES-CTR.
+func newSubkeyAEAD(key []byte, salt []byte, cipherSuite string) (cipher.AEAD, error) {
+	subkey, err := hkdfKey(key, salt, []byte(keyDerivationLabel+" "+cipherSuite), AESKeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(subkey)
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWithAEAD encrypts plaintext with a random nonce, which is prepended to
+// the result.
+func sealWithAEAD(aead cipher.AEAD, plaintext []byte, additional []byte) ([]byte, error) {
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed, plaintext, additional), nil
+}
+
+// openWithAEAD decrypts a ciphertext produced by sealWithAEAD.
+func openWithAEAD(aead cipher.AEAD, sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short to be valid")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
 func aesCTREncryptInMem(dst []byte, src []byte, key []byte) error {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -34,9 +34,15 @@ package jedi
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/rand"
+	"encoding/hex"
 	"testing"
+	"time"
+
+	"github.com/ucbrise/jedi-pairing/lang/go/cryptutils"
+	"github.com/ucbrise/jedi-pairing/lang/go/wkdibe"
 )
 
 func TestAESCTR(t *testing.T) {
@@ -65,3 +71,100 @@ func TestAESCTR(t *testing.T) {
 		t.Fatal("Original and decrypted messages differ")
 	}
 }
+
+func TestDeriveSymmetricKey(t *testing.T) {
+	_, encryptable := cryptutils.GenerateKey(make([]byte, keyDerivationSecretSize))
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+
+	derive := func(hierarchy string, uri string, cipherSuite string) []byte {
+		uriPath, err := ParseURI(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timePath, err := ParseTime(time.Unix(1565119330, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pattern := encoder.Encode(uriPath, timePath, PatternTypeDecryption)
+		key := make([]byte, AESKeySize)
+		if err = deriveSymmetricKey(key, encryptable, []byte(hierarchy), pattern, cipherSuite); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	reference := derive("hierarchy1", "a/b/c", cipherSuiteAES128CTR)
+	if !bytes.Equal(reference, derive("hierarchy1", "a/b/c", cipherSuiteAES128CTR)) {
+		t.Fatal("Key derivation is not deterministic")
+	}
+	if bytes.Equal(reference, derive("hierarchy2", "a/b/c", cipherSuiteAES128CTR)) {
+		t.Fatal("Derived keys do not depend on the hierarchy")
+	}
+	if bytes.Equal(reference, derive("hierarchy1", "a/b/d", cipherSuiteAES128CTR)) {
+		t.Fatal("Derived keys do not depend on the pattern")
+	}
+	if bytes.Equal(reference, derive("hierarchy1", "a/b/c", "other")) {
+		t.Fatal("Derived keys do not depend on the cipher suite")
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	/* Test Case 1 from RFC 5869. */
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+
+	okm, err := hkdfKey(secret, salt, info, len(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(okm, expected) {
+		t.Fatal("HKDF output does not match the test vector")
+	}
+}
+
+func TestDecryptLegacyKeyDerivation(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	ctx := context.Background()
+	now := time.Now()
+
+	_, pattern, err := NewTestState().encodePattern("a/b/c", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := info.ParamsForHierarchy(ctx, TestHierarchy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Encrypt a message the way older versions of JEDI did. */
+	var key [AESKeySize]byte
+	_, encryptable := cryptutils.GenerateKey(key[:])
+	deriveLegacySymmetricKey(key[:], encryptable)
+	header := wkdibe.Encrypt(encryptable, params, pattern.ToAttrs()).Marshal(true)
+	encrypted := make([]byte, len(header)+aes.BlockSize+len(quote1))
+	copy(encrypted, header)
+	if err = aesCTREncryptInMem(encrypted[len(header):], []byte(quote1), key[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewClientState(info, store, encoder, 1<<20, WithLegacyKeyDerivation(), WithUnversionedMessages())
+	decrypted, err := state.Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != quote1 {
+		t.Fatal("Could not decrypt a ciphertext using the legacy key derivation")
+	}
+
+	/* The current key derivation must not accept it. */
+	decrypted, err = NewTestState().Decrypt(ctx, TestHierarchy, "a/b/c", now, encrypted)
+	if err == nil && string(decrypted) == quote1 {
+		t.Fatal("Legacy ciphertext was decrypted with the current key derivation")
+	}
+
+	/* A legacy ClientState interoperates with itself. */
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", now.Add(time.Hour), quote2)
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultTenant is the tenant that owns the hierarchies not listed in the
+// Budgets of a TenantConfig without a Tenant function.
+const DefaultTenant = "default"
+
+// TenantConfig configures the cache budgets of a ClientState that serves
+// several tenants (see WithTenantBudgets).
+type TenantConfig struct {
+	// Tenant returns the tenant that owns a hierarchy. If it is nil, each
+	// hierarchy listed in Budgets is its own tenant, and all other
+	// hierarchies belong to DefaultTenant, so that hierarchies that are not
+	// known to the application (e.g., those named in requests from
+	// untrusted parties) share a single partition of the cache.
+	Tenant func(hierarchy []byte) string
+
+	// Budgets is the memory capacity (in bytes) of the cache partition of
+	// each tenant listed in it.
+	Budgets map[string]uint64
+
+	// DefaultBudget is the memory capacity (in bytes) of the cache partition
+	// of each tenant not listed in Budgets.
+	DefaultBudget uint64
+
+	// KindBudgets reserves a separate memory capacity (in bytes) for
+	// particular kinds of objects within each tenant's partition, as
+	// CacheConfig.Budgets does for the whole cache.
+	KindBudgets map[CacheKind]uint64
+}
+
+// TenantUsage reports how much of its budget a tenant is using.
+type TenantUsage struct {
+	// Budget is the memory capacity (in bytes) of the tenant's partition of
+	// the cache, not including any KindBudgets.
+	Budget uint64
+
+	// Bytes is the size of the objects in the tenant's partition.
+	Bytes uint64
+}
+
+// tenantCache is the Cache of a ClientState configured with
+// WithTenantBudgets. It keeps a separate LRU cache for each tenant, so that
+// objects are evicted only to make room for objects of the same tenant. The
+// budgets of the partitions that exist at once, including their
+// KindBudgets, add up to at most capacity; to make room for a new partition,
+// empty partitions, and then the least recently used ones, are reclaimed
+// along with their objects.
+type tenantCache struct {
+	config   TenantConfig
+	capacity uint64
+	size     func(key string, value interface{}) uint64
+	lock     sync.Mutex
+	tenants  map[string]*tenantPartition
+	order    *list.List
+	reserved uint64
+}
+
+// tenantPartition is the part of a tenantCache that holds one tenant's
+// objects. The number of calls using the partition is maintained atomically
+// in active; partitions are reclaimed only when it is zero.
+type tenantPartition struct {
+	tenant  string
+	cache   Cache
+	budget  uint64
+	reserve uint64
+	bytes   uint64
+	size    func(key string, value interface{}) uint64
+	elem    *list.Element
+	active  int32
+	lock    sync.Mutex
+	loaders map[CacheLoader]*tenantLoader
+}
+
+// tenantLoader wraps the CacheLoader of a ClientState to account the objects
+// that it loads into a tenantPartition to the partition's tenant. It keeps
+// the keys of those objects, protected by the partition's lock, so that they
+// can be evicted if the partition is reclaimed.
+type tenantLoader struct {
+	CacheLoader
+	partition *tenantPartition
+	keys      map[string]struct{}
+}
+
+func newTenantCache(config TenantConfig, capacity uint64, size func(key string, value interface{}) uint64) *tenantCache {
+	return &tenantCache{
+		config:   config,
+		capacity: capacity,
+		size:     size,
+		tenants:  make(map[string]*tenantPartition),
+		order:    list.New(),
+	}
+}
+
+// Load implements the CacheLoader interface.
+func (loader *tenantLoader) Load(ctx context.Context, key string) (interface{}, uint64, error) {
+	value, size, err := loader.CacheLoader.Load(ctx, key)
+	if err == nil {
+		atomic.AddUint64(&loader.partition.bytes, size)
+		loader.partition.lock.Lock()
+		loader.keys[key] = struct{}{}
+		loader.partition.lock.Unlock()
+	}
+	return value, size, err
+}
+
+// Evicted implements the CacheLoader interface.
+func (loader *tenantLoader) Evicted(key string, value interface{}) {
+	atomic.AddUint64(&loader.partition.bytes, ^(loader.partition.size(key, value) - 1))
+	loader.partition.lock.Lock()
+	delete(loader.keys, key)
+	loader.partition.lock.Unlock()
+	loader.CacheLoader.Evicted(key, value)
+}
+
+// tenant returns the tenant that owns the provided hierarchy.
+func (cache *tenantCache) tenant(hierarchy []byte) string {
+	if cache.config.Tenant != nil {
+		return cache.config.Tenant(hierarchy)
+	}
+	if _, ok := cache.config.Budgets[string(hierarchy)]; ok {
+		return string(hierarchy)
+	}
+	return DefaultTenant
+}
+
+// acquire returns the partition of the tenant that owns the object stored
+// under the provided key, creating it if necessary and create is true, and
+// marks it as active until the caller calls release. If the partition does
+// not exist and create is false, it returns nil.
+func (cache *tenantCache) acquire(key string, create bool) *tenantPartition {
+	_, ns := parsekey(key)
+	tenant := cache.tenant(ns)
+
+	cache.lock.Lock()
+	partition, ok := cache.tenants[tenant]
+	var reclaimed []*tenantPartition
+	if !ok {
+		if !create {
+			cache.lock.Unlock()
+			return nil
+		}
+		partition, reclaimed = cache.newPartition(tenant)
+	}
+	cache.order.MoveToFront(partition.elem)
+	atomic.AddInt32(&partition.active, 1)
+	cache.lock.Unlock()
+
+	/*
+	 * The reclaimed partitions are no longer reachable, and were not in use,
+	 * so their objects can be evicted without holding the lock.
+	 */
+	for _, old := range reclaimed {
+		old.clear()
+	}
+	return partition
+}
+
+// release marks a partition returned by acquire as no longer used by the
+// caller.
+func (partition *tenantPartition) release() {
+	atomic.AddInt32(&partition.active, -1)
+}
+
+// newPartition creates the partition of the provided tenant, reclaiming
+// other partitions to make room for its budget. It returns the new partition
+// and the reclaimed ones, whose objects the caller must evict once it
+// releases the cache's lock, which it must hold.
+func (cache *tenantCache) newPartition(tenant string) (*tenantPartition, []*tenantPartition) {
+	budget, ok := cache.config.Budgets[tenant]
+	if !ok {
+		budget = cache.config.DefaultBudget
+	}
+	kindBudgets := cache.config.KindBudgets
+	reserve := budget
+	for _, kindBudget := range kindBudgets {
+		reserve += kindBudget
+	}
+
+	/*
+	 * Reclaim every empty partition, and then the least recently used
+	 * partitions, until the new partition's budget fits. Partitions that are
+	 * in use are skipped.
+	 */
+	var reclaimed []*tenantPartition
+	for elem := cache.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		partition := elem.Value.(*tenantPartition)
+		if atomic.LoadInt32(&partition.active) == 0 && (atomic.LoadUint64(&partition.bytes) == 0 || reserve > cache.capacity-cache.reserved) {
+			delete(cache.tenants, partition.tenant)
+			cache.order.Remove(partition.elem)
+			cache.reserved -= partition.reserve
+			reclaimed = append(reclaimed, partition)
+		}
+		elem = prev
+	}
+
+	/*
+	 * If the partitions in use leave too little room, then the new
+	 * partition gets what is left, shared by all kinds of objects.
+	 */
+	if reserve > cache.capacity-cache.reserved {
+		budget = cache.capacity - cache.reserved
+		kindBudgets = nil
+		reserve = budget
+	}
+
+	partition := &tenantPartition{
+		tenant:  tenant,
+		cache:   NewLRUCache(CacheConfig{Capacity: budget, Budgets: kindBudgets}),
+		budget:  budget,
+		reserve: reserve,
+		size:    cache.size,
+		loaders: make(map[CacheLoader]*tenantLoader),
+	}
+	partition.elem = cache.order.PushFront(partition)
+	cache.tenants[tenant] = partition
+	cache.reserved += reserve
+	return partition, reclaimed
+}
+
+// clear evicts all of the objects in a reclaimed partition.
+func (partition *tenantPartition) clear() {
+	type object struct {
+		loader *tenantLoader
+		key    string
+	}
+	var objects []object
+	partition.lock.Lock()
+	for _, loader := range partition.loaders {
+		for key := range loader.keys {
+			objects = append(objects, object{loader: loader, key: key})
+		}
+	}
+	partition.lock.Unlock()
+
+	for _, obj := range objects {
+		partition.cache.Evict(obj.loader, cacheKindOf(obj.key), obj.key)
+	}
+}
+
+// loader returns the wrapper around the provided loader for this partition.
+func (partition *tenantPartition) loader(loader CacheLoader) *tenantLoader {
+	partition.lock.Lock()
+	defer partition.lock.Unlock()
+
+	wrapped, ok := partition.loaders[loader]
+	if !ok {
+		wrapped = &tenantLoader{
+			CacheLoader: loader,
+			partition:   partition,
+			keys:        make(map[string]struct{}),
+		}
+		partition.loaders[loader] = wrapped
+	}
+	return wrapped
+}
+
+// Get implements the Cache interface.
+func (cache *tenantCache) Get(ctx context.Context, loader CacheLoader, kind CacheKind, key string) (interface{}, error) {
+	partition := cache.acquire(key, true)
+	defer partition.release()
+	return partition.cache.Get(ctx, partition.loader(loader), kind, key)
+}
+
+// Evict implements the Cache interface.
+func (cache *tenantCache) Evict(loader CacheLoader, kind CacheKind, key string) {
+	partition := cache.acquire(key, false)
+	if partition == nil {
+		return
+	}
+	defer partition.release()
+	partition.cache.Evict(partition.loader(loader), kind, key)
+}
+
+// TenantUsage returns the budget and memory usage of each tenant that has
+// used the ClientState's cache, if it was configured with
+// WithTenantBudgets. Otherwise, it returns nil.
+func (state *ClientState) TenantUsage() map[string]TenantUsage {
+	cache, ok := state.cache.(*tenantCache)
+	if !ok {
+		return nil
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	usage := make(map[string]TenantUsage, len(cache.tenants))
+	for tenant, partition := range cache.tenants {
+		usage[tenant] = TenantUsage{
+			Budget: partition.budget,
+			Bytes:  atomic.LoadUint64(&partition.bytes),
+		}
+	}
+	return usage
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantBudgets(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	const budget = 16 << 10
+	metrics := NewMetrics()
+	state := NewClientState(info, store, encoder, 1<<20, WithObserver(metrics), WithTenantBudgets(TenantConfig{
+		Budgets:       map[string]uint64{"quiet": budget},
+		DefaultBudget: budget,
+	}))
+	now := time.Now()
+
+	quiet := []byte("quiet")
+	noisy := []byte("noisy")
+	testMessageTransfer(t, state, quiet, "a/b/c", now, quote1)
+	quietEntries := liveEntries(state)
+
+	/* A noisy tenant fills its own budget, but not the quiet tenant's. */
+	for i := 0; i != 100; i++ {
+		testMessageTransfer(t, state, noisy, fmt.Sprintf("a/b/%d", i), now, quote1)
+	}
+	if metrics.CacheStats(CacheKindEncryption).Evictions == 0 {
+		t.Fatal("Noisy tenant did not exceed its budget")
+	}
+	live := liveEntries(state)
+	for key := range quietEntries {
+		if _, ok := live[key]; !ok {
+			t.Fatalf("Quiet tenant's %v entry was evicted", cacheKindOf(key))
+		}
+	}
+
+	usage := state.TenantUsage()
+	if len(usage) != 2 {
+		t.Fatalf("Expected usage for 2 tenants, got %d", len(usage))
+	}
+	for tenant, u := range usage {
+		if u.Budget != budget || u.Bytes == 0 || u.Bytes > u.Budget {
+			t.Fatalf("Unexpected usage for tenant %q: %+v", tenant, u)
+		}
+	}
+	if usage[DefaultTenant].Bytes <= usage["quiet"].Bytes {
+		t.Fatal("Noisy tenant's usage is not reported")
+	}
+
+	/* Evicting everything returns each tenant's usage to zero. */
+	state.Close()
+	for tenant, u := range state.TenantUsage() {
+		if u.Bytes != 0 {
+			t.Fatalf("Tenant %q still uses %d bytes after Close", tenant, u.Bytes)
+		}
+	}
+}
+
+func TestTenantMapping(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(info, store, encoder, 1<<20, WithTenantBudgets(TenantConfig{
+		Tenant: func(hierarchy []byte) string {
+			return strings.SplitN(string(hierarchy), "/", 2)[0]
+		},
+		DefaultBudget: 1 << 20,
+	}))
+	now := time.Now()
+
+	testMessageTransfer(t, state, []byte("customer/one"), "a/b/c", now, quote1)
+	testMessageTransfer(t, state, []byte("customer/two"), "a/b/c", now, quote2)
+
+	usage := state.TenantUsage()
+	if len(usage) != 1 || usage["customer"].Bytes == 0 {
+		t.Fatalf("Unexpected tenant usage: %+v", usage)
+	}
+
+	if NewTestState().TenantUsage() != nil {
+		t.Fatal("ClientState without tenants reported tenant usage")
+	}
+}
+
+func TestTenantDefault(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	state := NewClientState(info, store, encoder, 1<<20, WithTenantBudgets(TenantConfig{
+		Budgets:       map[string]uint64{"known": 1 << 16},
+		DefaultBudget: 1 << 16,
+	}))
+	now := time.Now()
+
+	/* Hierarchies without a budget share the default tenant's partition. */
+	testMessageTransfer(t, state, []byte("known"), "a/b/c", now, quote1)
+	for i := 0; i != 10; i++ {
+		testMessageTransfer(t, state, []byte(fmt.Sprintf("unknown%d", i)), "a/b/c", now, quote1)
+	}
+
+	usage := state.TenantUsage()
+	if len(usage) != 2 || usage["known"].Bytes == 0 || usage[DefaultTenant].Bytes == 0 {
+		t.Fatalf("Unexpected tenant usage: %+v", usage)
+	}
+}
+
+func TestTenantCapacity(t *testing.T) {
+	info, store := NewTestKeyStore()
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	const budget = 16 << 10
+	const capacity = 3 * budget
+	state := NewClientState(info, store, encoder, capacity, WithTenantBudgets(TenantConfig{
+		Tenant: func(hierarchy []byte) string {
+			return string(hierarchy)
+		},
+		DefaultBudget: budget,
+	}))
+	now := time.Now()
+
+	/* Each new tenant's partition reclaims the least recently used one. */
+	for i := 0; i != 10; i++ {
+		testMessageTransfer(t, state, []byte(fmt.Sprintf("tenant%d", i)), "a/b/c", now, quote1)
+
+		usage := state.TenantUsage()
+		var total uint64
+		for _, u := range usage {
+			total += u.Budget
+		}
+		if total > capacity {
+			t.Fatalf("Tenants' budgets add up to %d bytes, over the capacity of %d", total, capacity)
+		}
+		if usage[fmt.Sprintf("tenant%d", i)].Bytes == 0 {
+			t.Fatal("Most recent tenant has no objects in the cache")
+		}
+	}
+	if _, ok := state.TenantUsage()["tenant0"]; ok {
+		t.Fatal("Least recently used tenant's partition was not reclaimed")
+	}
+
+	/* The objects of reclaimed partitions are evicted. */
+	for key := range liveEntries(state) {
+		if _, ns := parsekey(key); string(ns) == "tenant0" {
+			t.Fatalf("Reclaimed tenant's %v entry is still live", cacheKindOf(key))
+		}
+	}
+}
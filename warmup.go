@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// subscriptionRegistry holds the URIs that a ClientState's application has
+// subscribed to, for which qualified keys are precomputed before each hour
+// (see AddSubscription). Subscriptions are keyed as the encryption cache
+// entries for the same hierarchy and URI would be.
+type subscriptionRegistry struct {
+	lock          sync.Mutex
+	subscriptions map[string]subscription
+}
+
+// subscription is a URI in a hierarchy registered with AddSubscription.
+type subscription struct {
+	hierarchy []byte
+	uri       string
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{
+		subscriptions: make(map[string]subscription),
+	}
+}
+
+// parseSubscriptionURI parses the URI of a subscription, which must be fully
+// specified, since a message's pattern is.
+func parseSubscriptionURI(uri string) (URIPath, error) {
+	uriPath, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range uriPath {
+		if component == nil {
+			return nil, errors.New("Wildcard '+' not allowed in subscribed URI")
+		}
+	}
+	if len(uriPath) == 0 || uriPath[len(uriPath)-1].Name() != string(EndOfURISymbol) {
+		return nil, errors.New("Wildcard '*' not allowed in subscribed URI")
+	}
+	return uriPath, nil
+}
+
+// list returns the registered subscriptions.
+func (registry *subscriptionRegistry) list() []subscription {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	subscriptions := make([]subscription, 0, len(registry.subscriptions))
+	for _, sub := range registry.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions
+}
+
+// AddSubscription registers a URI in a hierarchy on which the application
+// expects to decrypt messages, so that WarmUp, and RunWarmUp, precompute the
+// qualified keys for it ahead of each hour. Otherwise, the first message on
+// the URI in each hour waits for the key store lookup and the qualification
+// of its key, in addition to its own decryption. The URI must be fully
+// specified, without wildcards.
+func (state *ClientState) AddSubscription(hierarchy []byte, uri string) error {
+	uriPath, err := parseSubscriptionURI(uri)
+	if err != nil {
+		return err
+	}
+
+	state.subscriptions.lock.Lock()
+	defer state.subscriptions.lock.Unlock()
+
+	state.subscriptions.subscriptions[encryptionCacheKey(hierarchy, uriPath)] = subscription{
+		hierarchy: append([]byte(nil), hierarchy...),
+		uri:       uri,
+	}
+	return nil
+}
+
+// RemoveSubscription unregisters a URI in a hierarchy registered with
+// AddSubscription. Qualified keys already precomputed for it are left in the
+// cache until they are evicted.
+func (state *ClientState) RemoveSubscription(hierarchy []byte, uri string) error {
+	uriPath, err := parseSubscriptionURI(uri)
+	if err != nil {
+		return err
+	}
+
+	state.subscriptions.lock.Lock()
+	defer state.subscriptions.lock.Unlock()
+
+	delete(state.subscriptions.subscriptions, encryptionCacheKey(hierarchy, uriPath))
+	return nil
+}
+
+// WarmUp precomputes, in the cache, the qualified keys needed to decrypt
+// messages for the TimePath of the provided time on each URI registered with
+// AddSubscription, under the epoch of public parameters under which new
+// messages are encrypted. The keys are qualified in turn; if any of them
+// cannot be, the rest are still qualified, and the first error is returned.
+func (state *ClientState) WarmUp(ctx context.Context, timestamp time.Time) error {
+	var first error
+	for _, sub := range state.subscriptions.list() {
+		if err := state.warmUpSubscription(ctx, sub, timestamp); err != nil {
+			if err == ErrClientStateClosed || ctx.Err() != nil {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// warmUpSubscription precomputes the qualified key for one subscription, as
+// described for WarmUp.
+func (state *ClientState) warmUpSubscription(ctx context.Context, sub subscription, timestamp time.Time) error {
+	_, pattern, err := state.encodePattern(sub.uri, timestamp)
+	if err != nil {
+		return err
+	}
+
+	entryInt, err := state.cacheGet(ctx, hierarchyCacheKey(sub.hierarchy))
+	if err != nil {
+		return err
+	}
+	epoch, err := state.encryptionParamEpoch(entryInt.(*hierarchyCacheEntry))
+	if err != nil {
+		return err
+	}
+
+	_, err = state.cacheGet(ctx, qualifiedKeyCacheKey(sub.hierarchy, epoch.Epoch, pattern))
+	return err
+}
+
+// RunWarmUp calls WarmUp for each hour, the provided lead time before the
+// hour begins, until ctx is cancelled or the ClientState is closed. It should
+// be run in its own goroutine by applications that subscribe to URIs, so that
+// the first message of each hour is decrypted as quickly as the rest. Errors
+// in qualifying individual keys do not stop it; the keys are qualified when
+// they are first needed instead.
+func (state *ClientState) RunWarmUp(ctx context.Context, lead time.Duration) error {
+	var warmed time.Time
+	for {
+		/*
+		 * Warm up each hour once, even if the lead time is longer than an
+		 * hour; once the next hour is warmed up, wait for it to begin.
+		 */
+		boundary := time.Now().Truncate(time.Hour).Add(time.Hour)
+		wake := boundary.Add(-lead)
+		if boundary.Equal(warmed) {
+			wake = boundary
+		}
+
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		if boundary.Equal(warmed) {
+			continue
+		}
+		if err := state.WarmUp(ctx, boundary); err == ErrClientStateClosed {
+			return err
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		warmed = boundary
+	}
+}
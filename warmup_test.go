@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2019, Sam Kumar <samkumar@cs.berkeley.edu>
+ * Copyright (c) 2019, University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jedi
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func NewWarmUpTestState() (*ClientState, *countingKeyStore) {
+	info, store := NewTestKeyStore()
+	counting := &countingKeyStore{KeyStoreReader: store}
+	encoder := NewDefaultPatternEncoder(TestPatternSize - MaxTimeLength)
+	return NewClientState(info, counting, encoder, 1<<20), counting
+}
+
+func TestWarmUp(t *testing.T) {
+	state, counting := NewWarmUpTestState()
+	ctx := context.Background()
+	next := time.Now().Truncate(time.Hour).Add(time.Hour)
+
+	if err := state.AddSubscription(TestHierarchy, "a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.AddSubscription(TestHierarchy, "a/b/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.WarmUp(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 2 {
+		t.Fatalf("Expected 2 key store lookups while warming up, got %d", lookups)
+	}
+
+	/* The first messages of the next hour need no more lookups. */
+	testMessageTransfer(t, state, TestHierarchy, "a/b/c", next, quote1)
+	testMessageTransfer(t, state, TestHierarchy, "a/b/d", next.Add(time.Minute), quote2)
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 2 {
+		t.Fatalf("Expected no key store lookups after warming up, got %d", lookups-2)
+	}
+
+	/* Removed subscriptions are no longer warmed up. */
+	if err := state.RemoveSubscription(TestHierarchy, "a/b/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.WarmUp(ctx, next.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 3 {
+		t.Fatalf("Expected 3 key store lookups, got %d", lookups)
+	}
+}
+
+func TestAddSubscriptionWildcard(t *testing.T) {
+	state := NewTestState()
+	for _, uri := range []string{"a/b/*", "a/+/c", "*"} {
+		if err := state.AddSubscription(TestHierarchy, uri); err == nil {
+			t.Fatalf("Subscribed to URI %q with a wildcard", uri)
+		}
+	}
+}
+
+func TestRunWarmUp(t *testing.T) {
+	state, counting := NewWarmUpTestState()
+	if err := state.AddSubscription(TestHierarchy, "a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* With an hour of lead time, the next hour is warmed up at once. */
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- state.RunWarmUp(ctx, time.Hour)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&counting.lookups) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Next hour was not warmed up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("RunWarmUp returned %v", err)
+	}
+	if lookups := atomic.LoadInt32(&counting.lookups); lookups != 1 {
+		t.Fatalf("Expected 1 key store lookup, got %d", lookups)
+	}
+}